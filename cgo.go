@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cespare/grb/internal/grb"
+)
+
+// A headerDir holds the C headers found in a directory of a GOPATH.
+type headerDir struct {
+	dir   string // local path
+	names map[string]bool
+}
+
+// includeRE matches #include directives, capturing the kind of quote and
+// the name of the header.
+var includeRE = regexp.MustCompile(`(?m)^[ \t]*#[ \t]*include[ \t]*([<"])([^">\n]+)[">]`)
+
+// findHeaders finds the C headers in pkg's GOPATH that its cgo code
+// includes, directly or indirectly, such as "../common/x.h" or headers in a
+// directory given with -I in a #cgo directive. They are recorded in
+// f.headers, keyed by their directories relative to the GOPATH's src
+// directory, and later added to the build by addHeaders. Headers elsewhere,
+// such as system headers, are assumed to be on the server.
+//
+// Includes are found by scanning the files for #include directives, so
+// headers may be included that the preprocessor wouldn't use.
+func (f *packageFinder) findHeaders(pkg *build.Package) error {
+	if len(pkg.CgoFiles) == 0 || pkg.SrcRoot == "" {
+		return nil
+	}
+	var incDirs []string
+	for _, flags := range [][]string{pkg.CgoCPPFLAGS, pkg.CgoCFLAGS, pkg.CgoCXXFLAGS} {
+		for i := 0; i < len(flags); i++ {
+			var dir string
+			switch flag := flags[i]; {
+			case flag == "-I" || flag == "-iquote" || flag == "-isystem":
+				if i+1 < len(flags) {
+					i++
+					dir = flags[i]
+				}
+			case strings.HasPrefix(flag, "-I"):
+				dir = flag[len("-I"):]
+			}
+			if dir == "" {
+				continue
+			}
+			if !filepath.IsAbs(dir) {
+				// The C compiler runs in the package directory.
+				dir = filepath.Join(pkg.Dir, dir)
+			}
+			incDirs = append(incDirs, dir)
+		}
+	}
+	var queue []string
+	seen := make(map[string]bool)
+	for _, fs := range [][]string{pkg.CgoFiles, pkg.CFiles, pkg.CXXFiles, pkg.MFiles, pkg.HFiles} {
+		for _, name := range fs {
+			path := filepath.Join(pkg.Dir, name)
+			queue = append(queue, path)
+			seen[path] = true
+		}
+	}
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(b, []byte("include")) {
+			continue
+		}
+		for _, m := range includeRE.FindAllSubmatch(b, -1) {
+			dirs := incDirs
+			if string(m[1]) == `"` {
+				dirs = append([]string{filepath.Dir(path)}, incDirs...)
+			}
+			header := findHeader(string(m[2]), dirs)
+			if header == "" || seen[header] {
+				continue
+			}
+			seen[header] = true
+			rel, err := filepath.Rel(pkg.SrcRoot, filepath.Dir(header))
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			hd := f.headers[rel]
+			if hd == nil {
+				hd = &headerDir{dir: filepath.Dir(header), names: make(map[string]bool)}
+				f.headers[rel] = hd
+			}
+			hd.names[filepath.Base(header)] = true
+			queue = append(queue, header)
+		}
+	}
+	return nil
+}
+
+// findHeader returns the path of the header called name in the first of
+// dirs that has it, or "" if there is none.
+func findHeader(name string, dirs []string) string {
+	for _, dir := range dirs {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// addHeaders adds the headers found by findHeaders to packages: each to the
+// package in the same directory, if there is one, or else to a new Package
+// for the directory, so that the server puts it at the same place relative
+// to the packages that include it.
+func (f *packageFinder) addHeaders(packages []*grb.Package) ([]*grb.Package, error) {
+	byName := make(map[string]*grb.Package)
+	for _, p := range packages {
+		byName[p.Name] = p
+	}
+	var dirs []string
+	for dir := range f.headers {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		hd := f.headers[dir]
+		p := byName[dir]
+		if p == nil {
+			p = &grb.Package{
+				Name:    dir,
+				Version: f.versions.version(hd.dir),
+			}
+			byName[dir] = p
+			packages = append(packages, p)
+		}
+		var names []string
+		for name := range hd.names {
+			if !hasFile(p, name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		files, err := grb.HashFiles(hd.dir, names)
+		if err != nil {
+			return nil, err
+		}
+		p.Files = append(p.Files, files...)
+	}
+	return packages, nil
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/cespare/grb/internal/grb"
 	"github.com/cespare/hutil/apachelog"
@@ -17,13 +21,94 @@ func main() {
 		tls     = flag.Bool("tls", false, "serve HTTPS traffic (-tlscert and -tlskey must be provided)")
 		tlsCert = flag.String("tlscert", "", "cert.pem for TLS")
 		tlsKey  = flag.String("tlskey", "", "cert.key for TLS")
+		signKey = flag.String("signkey", "", "sign artifacts with the ed25519 private key in this PEM file")
+		genKey  = flag.Bool("genkey", false, "generate a new private key at the -signkey path, print its public key, and exit")
+
+		overlay      = flag.Bool("overlay", false, "build using go build -overlay rather than creating a GOPATH tree for each build (requires Go 1.16+)")
+		gocacheMB    = flag.Int64("gocachemb", 10<<10, "maximum total size, in MB, of the Go build caches (one per toolchain) kept by the server (0 means unlimited)")
+		provenanceMB = flag.Int64("provenancemb", 1<<10, "maximum total size, in MB, of the build provenance documents kept by the server (0 means unlimited)")
+		vulnDB       = flag.String("vulndb", "", "check builds against the Go vulnerability database snapshot in this directory")
+		vulnFail     = flag.Bool("vulnfail", false, "refuse to build packages with known vulnerabilities (requires -vulndb)")
+		runTimeout   = flag.Duration("runtimeout", 0, "maximum time that a binary run on the server with grb run may take (0, the default, disables grb run; it's only supported on Linux)")
+		testTimeout  = flag.Duration("testtimeout", 0, "maximum time that go test run on the server with grb test may take (0, the default, disables grb test; it's only supported on Linux)")
+		analyzers    = flag.String("analyzers", "", "comma-separated list of name=path pairs naming vet tools (built with golang.org/x/tools/go/analysis/unitchecker) that clients may run with grb vet")
+		buildEnv     = flag.String("buildenv", "CGO_ENABLED=0|1", "comma-separated list of the environment variables (CGO_ENABLED, CGO_CFLAGS, CGO_LDFLAGS, or CC) that clients may set for builds, each optionally followed by = and a |-separated list of the values allowed (allowing any value for the last three lets clients run programs on the server)")
+		linkMode     = flag.String("linkmode", "hardlink", "how to place cached files in build trees: hardlink, reflink, or copy (falls back to later modes if unsupported)")
+
+		s3Endpoint = flag.String("s3endpoint", "https://s3.amazonaws.com", "S3-compatible endpoint URL for -s3bucket")
+		s3Region   = flag.String("s3region", "us-east-1", "region for -s3bucket")
+		s3Bucket   = flag.String("s3bucket", "", "keep the file cache in this S3 bucket (credentials are read from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY)")
+		s3Prefix   = flag.String("s3prefix", "", "key prefix for objects in -s3bucket")
 	)
 	flag.Parse()
 
+	if *genKey {
+		if *signKey == "" {
+			log.Fatal("-genkey requires -signkey")
+		}
+		key, err := grb.GenerateSigningKey(*signKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(grb.EncodePublicKey(key.Public().(ed25519.PublicKey)))
+		return
+	}
+
 	server, err := grb.NewServer(*dataDir, *goroot)
 	if err != nil {
 		log.Fatal(err)
 	}
+	server.LinkMode, err = grb.ParseLinkMode(*linkMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *signKey != "" {
+		server.SigningKey, err = grb.LoadSigningKey(*signKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *vulnDB != "" {
+		server.VulnDB, err = grb.LoadVulnDB(*vulnDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.FailOnVulns = *vulnFail
+	}
+	server.Overlay = *overlay
+	server.GOCACHEMaxSize = *gocacheMB << 20
+	server.ProvenanceMaxSize = *provenanceMB << 20
+	server.RunTimeout = *runTimeout
+	server.TestTimeout = *testTimeout
+	if *analyzers != "" {
+		server.Analyzers = make(map[string]string)
+		for _, a := range strings.Split(*analyzers, ",") {
+			kv := strings.SplitN(a, "=", 2)
+			if len(kv) != 2 {
+				log.Fatalf("Bad -analyzers entry %q (want name=path)", a)
+			}
+			server.Analyzers[kv[0]] = kv[1]
+		}
+	}
+	server.BuildEnv, err = grb.ParseBuildEnv(*buildEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *s3Bucket != "" {
+		// The local cache directory holds copies of the blobs we build with.
+		server.Cache = &grb.CachedStore{
+			Remote: &grb.S3Store{
+				Endpoint:     *s3Endpoint,
+				Region:       *s3Region,
+				Bucket:       *s3Bucket,
+				Prefix:       *s3Prefix,
+				AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			},
+			Local: server.Cache.(grb.FileStore),
+		}
+	}
 	if *tls && (*tlsCert == "" || *tlsKey == "") {
 		log.Fatal("If -tls is given, -tlscert and -tlskey must also be provided")
 	}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -14,6 +17,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"strings"
 	"time"
@@ -26,23 +30,85 @@ const (
 	parallelism = 10
 )
 
-func FindPackages(pkgName string, env *Env, gopath string) ([]*grb.Package, error) {
+// FindOptions holds the settings of a build, other than its platform, that
+// decide which files it needs.
+type FindOptions struct {
+	// Tags are the build tags, including those implied by flags such as
+	// -race.
+	Tags []string
+	// PGO is the profile for profile-guided optimization, as for go build
+	// -pgo: a file, which is sent as default.pgo in each main package;
+	// "auto" (or empty), to send the main packages' own default.pgo; or
+	// "off".
+	PGO string
+	// Env holds the environment variables for the build on the server.
+	// CGO_ENABLED decides whether cgo files are needed.
+	Env map[string]string
+}
+
+// FindPackages finds the non-stdlib packages needed to build the packages in
+// pkgNames.
+func FindPackages(pkgNames []string, env *Env, gopath string, opts *FindOptions) ([]*grb.Package, error) {
+	return findPackages(pkgNames, env, gopath, opts, false)
+}
+
+// FindTestPackages is like FindPackages, but it finds the packages needed to
+// test the packages in pkgNames, including their test files and testdata.
+func FindTestPackages(pkgNames []string, env *Env, gopath string, opts *FindOptions) ([]*grb.Package, error) {
+	return findPackages(pkgNames, env, gopath, opts, true)
+}
+
+func findPackages(pkgNames []string, env *Env, gopath string, opts *FindOptions, tests bool) ([]*grb.Package, error) {
 	ctx := build.Default
 	if gopath != "" {
 		ctx.GOPATH = gopath
 	}
 	ctx.GOOS = env.GOOS
 	ctx.GOARCH = env.GOARCH
+	ctx.BuildTags = opts.Tags
+	// Unless the build turns cgo on or off, the server's default applies.
+	if cgo, ok := opts.Env["CGO_ENABLED"]; ok {
+		ctx.CgoEnabled = cgo == "1"
+	} else if env.CgoEnabled != "" {
+		ctx.CgoEnabled = env.CgoEnabled == "1"
+	}
 	var err error
 	ctx.GOROOT, err = findGOROOT()
 	if err != nil {
 		return nil, err
 	}
-	pkg, err := ctx.Import(pkgName, ".", build.FindOnly)
-	if err != nil {
-		return nil, err
+	f := &packageFinder{
+		ctx:      &ctx,
+		pgo:      opts.PGO,
+		found:    make(map[string]struct{}),
+		tests:    make(map[string]bool),
+		headers:  make(map[string]*headerDir),
+		versions: newVersionFinder(ctx.SrcDirs()),
 	}
-	return findPackages(pkgName, pkg.Dir, &ctx, make(map[string]struct{}))
+	if tests {
+		for _, pkgName := range pkgNames {
+			f.tests[pkgName] = true
+		}
+	}
+	var packages []*grb.Package
+	for _, pkgName := range pkgNames {
+		// A package may already have been found as a dependency of
+		// another.
+		if _, ok := f.found[pkgName]; ok {
+			continue
+		}
+		f.found[pkgName] = struct{}{}
+		pkg, err := ctx.Import(pkgName, ".", build.FindOnly)
+		if err != nil {
+			return nil, err
+		}
+		pkgs, err := f.find(pkgName, pkg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, pkgs...)
+	}
+	return f.addHeaders(packages)
 }
 
 // findGOROOT finds the GOROOT associated with the `go` command in $PATH.
@@ -68,11 +134,21 @@ func findGOROOT() (string, error) {
 	return env.GOROOT, nil
 }
 
-func findPackages(pkgName, srcDir string, ctx *build.Context, alreadyFound map[string]struct{}) ([]*grb.Package, error) {
+// A packageFinder finds the non-stdlib packages needed to build a package.
+type packageFinder struct {
+	ctx      *build.Context
+	pgo      string
+	found    map[string]struct{}
+	tests    map[string]bool // packages whose tests are needed too
+	headers  map[string]*headerDir
+	versions *versionFinder
+}
+
+func (f *packageFinder) find(pkgName, srcDir string) ([]*grb.Package, error) {
 	if pkgName == "C" {
 		return nil, nil
 	}
-	pkg, err := ctx.Import(pkgName, srcDir, 0)
+	pkg, err := f.ctx.Import(pkgName, srcDir, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -80,28 +156,129 @@ func findPackages(pkgName, srcDir string, ctx *build.Context, alreadyFound map[s
 		// ignore stdlib
 		return nil, nil
 	}
+	imports := pkg.Imports
+	if f.tests[pkg.ImportPath] {
+		imports = append(append(append([]string(nil), imports...), pkg.TestImports...), pkg.XTestImports...)
+	}
 	var packages []*grb.Package
-	for _, depPkgName := range pkg.Imports {
-		if _, ok := alreadyFound[depPkgName]; ok {
+	for _, depPkgName := range imports {
+		if _, ok := f.found[depPkgName]; ok {
 			continue
 		}
-		alreadyFound[depPkgName] = struct{}{}
-		depPkg, err := findPackages(depPkgName, pkg.Dir, ctx, alreadyFound)
+		f.found[depPkgName] = struct{}{}
+		depPkg, err := f.find(depPkgName, pkg.Dir)
 		if err != nil {
 			return nil, err
 		}
 		packages = append(packages, depPkg...)
 	}
-	p, err := grb.NewPackage(pkg)
+	newPackage := grb.NewPackage
+	if f.tests[pkg.ImportPath] {
+		newPackage = grb.NewTestPackage
+	}
+	p, err := newPackage(pkg)
 	if err != nil {
 		return nil, err
 	}
+	if pkg.Name == "main" {
+		if err := f.addProfile(p, pkg.Dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.findHeaders(pkg); err != nil {
+		return nil, err
+	}
+	p.Version = f.versions.version(pkg.Dir)
 	packages = append(packages, p)
 	return packages, nil
 }
 
+// addProfile adds the profile for profile-guided optimization, if any, to
+// the main package p in dir.
+func (f *packageFinder) addProfile(p *grb.Package, dir string) error {
+	switch f.pgo {
+	case "off":
+		return nil
+	case "", "auto":
+		if _, err := os.Stat(filepath.Join(dir, "default.pgo")); os.IsNotExist(err) {
+			return nil
+		}
+		files, err := grb.HashFiles(dir, []string{"default.pgo"})
+		if err != nil {
+			return err
+		}
+		p.Files = append(p.Files, files...)
+	default:
+		files, err := grb.HashFiles(filepath.Dir(f.pgo), []string{filepath.Base(f.pgo)})
+		if err != nil {
+			return err
+		}
+		files[0].Name = "default.pgo"
+		p.Files = append(p.Files, files...)
+	}
+	return nil
+}
+
+// parseTargets parses a comma-separated list of GOOS/GOARCH targets.
+func parseTargets(s string) ([]grb.Target, error) {
+	var targets []grb.Target
+	for _, s := range strings.Split(s, ",") {
+		t, err := grb.ParseTarget(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range targets {
+			if t == other {
+				return nil, fmt.Errorf("duplicate target %s", t)
+			}
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// parseTags parses a list of build tags, which, as for go build, may be
+// separated by commas or (in the older style) spaces.
+func parseTags(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// mergePackages merges the packages needed for several builds (such as for
+// different targets) into a single list with the union of their files.
+func mergePackages(lists [][]*grb.Package) []*grb.Package {
+	var merged []*grb.Package
+	byName := make(map[string]*grb.Package)
+	for _, pkgs := range lists {
+		for _, pkg := range pkgs {
+			m, ok := byName[pkg.Name]
+			if !ok {
+				m = &grb.Package{Name: pkg.Name, Version: pkg.Version}
+				byName[pkg.Name] = m
+				merged = append(merged, m)
+			}
+			for _, file := range pkg.Files {
+				if !hasFile(m, file.Name) {
+					m.Files = append(m.Files, file)
+				}
+			}
+		}
+	}
+	return merged
+}
+
+func hasFile(pkg *grb.Package, name string) bool {
+	for _, file := range pkg.Files {
+		if file.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 var (
-	errStatusNot200 = errors.New("non-200 status from build server")
+	errStatusNot200  = errors.New("non-200 status from build server")
+	errVulnerable    = errors.New("build includes packages with known vulnerabilities")
+	errTargetsFailed = errors.New("build failed for some targets")
 )
 
 type BuildConfig struct {
@@ -110,49 +287,162 @@ type BuildConfig struct {
 	OutputName string
 	Flags      []string
 	GOPATH     string
+
+	// Find decides which files are sent to the server, and its Env is
+	// sent as the environment of the build. Its Tags must match Flags,
+	// and if its PGO is a profile, Flags must not have -pgo.
+	Find FindOptions
+
+	// PkgNames, if set, lists several packages to build at once instead of
+	// PkgName. OutputName is then the directory in which to write the
+	// binaries.
+	PkgNames []string
+
+	// Targets, if set, lists the platforms to build for instead of the
+	// server's. Each binary's name gets a _GOOS_GOARCH suffix.
+	Targets []grb.Target
+
+	// DebName, if set, is where to write a Debian package, described by Deb,
+	// holding the binary. Deb's architecture is set from the target.
+	DebName string
+	Deb     *grb.DebPackage
+
+	// ImageName, if set, is where to write an OCI image layout, described
+	// by Image, holding the binary. Image's platform is set from the target.
+	ImageName string
+	Image     *grb.Image
+
+	// Test runs the packages' tests on the server, instead of building
+	// them, passing TestFlags to go test. The test output is printed as
+	// go test would, or as JSON events (like go test -json) if TestJSON is
+	// set. If the tests fail, the error is an *exitStatusError.
+	Test      bool
+	TestFlags []string
+	TestJSON  bool
+
+	// Run runs the binary on the server with RunArgs, instead of
+	// downloading it, and prints its output. If the binary fails, the error
+	// is an *exitStatusError.
+	Run     bool
+	RunArgs []string
+
+	// Vet runs go vet on the packages, including their tests, on the
+	// server, along with the extra Analyzers configured there, and prints
+	// the diagnostics (as JSON, if VetJSON is set). If there are any, the
+	// error is errVetFailed.
+	Vet       bool
+	VetJSON   bool
+	Analyzers []string
+
+	// Stdout is where the hashes of the artifacts, or the test output, are
+	// printed. If nil, os.Stdout is used.
+	Stdout io.Writer
+
+	// ProvenanceName and SBOMName, if set, are where to write the
+	// provenance and the software bill of materials of the build.
+	ProvenanceName string
+	SBOMName       string
+
+	// PublicKey, if set, is the server's public key. The artifact must be
+	// signed with the corresponding private key.
+	PublicKey ed25519.PublicKey
+
+	// VulnDB, if set, is used to check the packages in the build for known
+	// vulnerabilities before sending them to the server. If FailOnVulns is
+	// set, the build fails if there are any.
+	VulnDB      *grb.VulnDB
+	FailOnVulns bool
+
+	// Verify checks that the build, which must use -trimpath, is
+	// reproducible instead of downloading the result. VerifyLocal
+	// additionally compares against a local build of the files sent to
+	// the server.
+	Verify      bool
+	VerifyLocal bool
+}
+
+func (conf *BuildConfig) stdout() io.Writer {
+	if conf.Stdout == nil {
+		return os.Stdout
+	}
+	return conf.Stdout
 }
 
 type Env struct {
 	GOOS    string
 	GOARCH  string
 	Version string
+	// CgoEnabled is the server's default CGO_ENABLED setting, "1" or
+	// "0", or empty if the server doesn't report it.
+	CgoEnabled string
 }
 
 func runBuild(conf *BuildConfig) error {
 	// Step 1: Get server environment info so we know what files to send,
 	// then determine all dependencies and their files.
 
-	url := conf.ServerURL + "/version?format=json"
 	client := newHTTPClient()
-	log.Println("GET", url)
-	resp, err := client.Get(url)
+	env, err := fetchEnv(conf.ServerURL, client)
 	if err != nil {
-		log.Println("Error making GET request:", err)
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		log.Println("Non-200 status code from version:", resp.StatusCode)
-		return errStatusNot200
+
+	pkgNames := conf.PkgNames
+	if pkgNames == nil {
+		pkgNames = []string{conf.PkgName}
 	}
-	var env Env
-	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
-		log.Println("Could not decode /version JSON:", err)
-		return err
+	log.Println("Finding dependencies of", strings.Join(pkgNames, " "))
+	find := FindPackages
+	if conf.Test || conf.Vet {
+		find = FindTestPackages
 	}
-	log.Printf("Remote server has environment %+v", env)
-
-	log.Println("Finding dependencies of", conf.PkgName)
-	pkgs, err := FindPackages(conf.PkgName, &env, conf.GOPATH)
-	if err != nil {
-		return err
+	var pkgs []*grb.Package
+	if conf.Targets != nil {
+		// Different targets may need different files.
+		var lists [][]*grb.Package
+		for _, t := range conf.Targets {
+			targetEnv := *env
+			targetEnv.GOOS = t.GOOS
+			targetEnv.GOARCH = t.GOARCH
+			if t.GOOS != env.GOOS || t.GOARCH != env.GOARCH {
+				// As with go build, cgo is off by default when
+				// cross-compiling.
+				targetEnv.CgoEnabled = "0"
+			}
+			found, err := find(pkgNames, &targetEnv, conf.GOPATH, &conf.Find)
+			if err != nil {
+				return fmt.Errorf("%s: %s", t, err)
+			}
+			lists = append(lists, found)
+		}
+		pkgs = mergePackages(lists)
+	} else {
+		pkgs, err = find(pkgNames, env, conf.GOPATH, &conf.Find)
+		if err != nil {
+			return err
+		}
 	}
 	log.Printf("Found %d packages for build", len(pkgs))
+	if conf.VulnDB != nil {
+		if vulns := conf.VulnDB.Check(pkgs); len(vulns) > 0 {
+			fmt.Fprintf(os.Stderr, "Packages with known vulnerabilities:\n%s", grb.VulnReport(vulns))
+			if conf.FailOnVulns && grb.AnyAffected(vulns) {
+				return errVulnerable
+			}
+		}
+	}
 
 	breq := &grb.BuildRequest{
-		PackageName: conf.PkgName,
-		Packages:    pkgs,
-		Flags:       conf.Flags,
+		PackageName:  conf.PkgName,
+		PackageNames: conf.PkgNames,
+		Targets:      conf.Targets,
+		Packages:     pkgs,
+		Flags:        conf.Flags,
+		Env:          conf.Find.Env,
+		TestFlags:    conf.TestFlags,
+		RunArgs:      conf.RunArgs,
+		Analyzers:    conf.Analyzers,
+		User:         currentUser(),
 	}
 	var buf bytes.Buffer
 	encoder := json.NewEncoder(&buf)
@@ -163,14 +453,20 @@ func runBuild(conf *BuildConfig) error {
 	// Step 2: POST /begin to kick off the build.
 	// The response says which files the server doesn't know about.
 
-	url = conf.ServerURL + "/begin"
+	url := conf.ServerURL + "/begin"
 	log.Println("POST", url)
-	resp, err = client.Post(url, "application/json", &buf)
+	resp, err := client.Post(url, "application/json", &buf)
 	if err != nil {
 		log.Println("Error making POST request:", err)
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == 412 || resp.StatusCode == 400 {
+		// The server explains why it won't do the build, such as
+		// flags that it doesn't allow.
+		log.Println("Build refused:")
+		io.Copy(os.Stderr, resp.Body)
+	}
 	if resp.StatusCode != 200 {
 		log.Println("Non-200 status code from /begin:", resp.StatusCode)
 		return errStatusNot200
@@ -182,6 +478,9 @@ func runBuild(conf *BuildConfig) error {
 		log.Println("JSON decoding error with result of /begin:", err)
 		return err
 	}
+	if len(bresp.Vulns) > 0 {
+		fmt.Fprintf(os.Stderr, "Build server reports packages with known vulnerabilities:\n%s", grb.VulnReport(bresp.Vulns))
+	}
 
 	// Step 3: POST /upload to send all the missing files to the server.
 
@@ -198,6 +497,19 @@ func runBuild(conf *BuildConfig) error {
 	}
 	log.Printf("Successfully uploaded %d files from %d packages", nFiles, len(bresp.Missing))
 
+	if conf.Verify {
+		return verifyBuild(conf, client, env, bresp.ID, pkgs)
+	}
+	if conf.Test {
+		return runTests(conf, client, bresp.ID, pkgs)
+	}
+	if conf.Run {
+		return runRemote(conf, client, bresp.ID)
+	}
+	if conf.Vet {
+		return runVet(conf, client, bresp.ID, pkgs)
+	}
+
 	// Step 4: GET /build to build and download the result.
 
 	url = conf.ServerURL + "/build/" + bresp.ID
@@ -207,6 +519,7 @@ func runBuild(conf *BuildConfig) error {
 		log.Println("Error making GET request:", err)
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == 412 {
 		log.Println("Build error:")
 		io.Copy(os.Stderr, resp.Body)
@@ -215,29 +528,365 @@ func runBuild(conf *BuildConfig) error {
 		log.Println("Non-200 status code from /begin:", resp.StatusCode)
 		return errStatusNot200
 	}
-	f, err := os.Create(conf.OutputName)
+	log.Println("200 result for GET request; downloading/writing result")
+	var digests []string
+	var manifest grb.BuildManifest
+	if conf.PkgNames != nil || conf.Targets != nil {
+		if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+			log.Println("Could not decode build manifest:", err)
+			return err
+		}
+		digests, err = downloadArtifacts(conf, client, env, bresp.ID, &manifest)
+		if err != nil {
+			return err
+		}
+	} else {
+		want := &grb.ArtifactMetadata{
+			BuildID: bresp.ID,
+			Package: conf.PkgName,
+			GOOS:    env.GOOS,
+			GOARCH:  env.GOARCH,
+			Flags:   conf.Flags,
+		}
+		digest, err := downloadArtifact(resp, conf.OutputName, conf.PublicKey, want)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(conf.stdout(), "%s  %s\n", digest, conf.OutputName)
+		digests = []string{digest}
+		if conf.DebName != "" {
+			if err := writeDeb(conf, env); err != nil {
+				return err
+			}
+		}
+		if conf.ImageName != "" {
+			if err := writeImage(conf, env); err != nil {
+				return err
+			}
+		}
+	}
+	if conf.ProvenanceName != "" {
+		if err := downloadProvenance(conf, client, bresp.ID, digests); err != nil {
+			return err
+		}
+	}
+	if conf.SBOMName != "" {
+		b, err := fetchBuildRecord(conf, client, "sbom", bresp.ID)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(conf.SBOMName, b, 0644); err != nil {
+			return err
+		}
+	}
+	if conf.Targets != nil {
+		if err := reportTargets(conf.Targets, &manifest); err != nil {
+			return err
+		}
+	}
+	log.Println("Build complete")
+	return nil
+}
+
+// writeDeb packages the binary conf.OutputName, built for env, as
+// conf.DebName.
+func writeDeb(conf *BuildConfig, env *Env) error {
+	if env.GOOS != "linux" {
+		return fmt.Errorf("can't make a Debian package for GOOS=%s", env.GOOS)
+	}
+	arch, err := grb.DebArch(env.GOARCH)
 	if err != nil {
 		return err
 	}
-	log.Println("200 result for GET request; downloading/writing result")
-	if _, err := io.Copy(f, resp.Body); err != nil {
-		log.Println("Error downloading file to disk:", err)
+	deb := *conf.Deb
+	deb.Arch = arch
+	return writePackaged(conf, conf.DebName, deb.Write)
+}
+
+// writeImage packages the binary conf.OutputName, built for env, as an OCI
+// image layout in conf.ImageName.
+func writeImage(conf *BuildConfig, env *Env) error {
+	img := *conf.Image
+	img.GOOS = env.GOOS
+	img.GOARCH = env.GOARCH
+	return writePackaged(conf, conf.ImageName, img.Write)
+}
+
+// writePackaged writes name using write, which packages the binary
+// conf.OutputName in some form, and prints its hash.
+func writePackaged(conf *BuildConfig, name string, write func(w io.Writer, bin []byte) error) error {
+	bin, err := ioutil.ReadFile(conf.OutputName)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), ".grb-package-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// only needed in error cases
 		f.Close()
-		os.Remove(conf.OutputName)
+		os.Remove(f.Name())
+	}()
+	h := sha256.New()
+	if err := write(io.MultiWriter(f, h), bin); err != nil {
 		return err
 	}
 	if err := f.Close(); err != nil {
-		log.Println("Error writing/closing output file:", err)
 		return err
 	}
-	if err := os.Chmod(conf.OutputName, 0755); err != nil {
-		log.Println("Chmod error with output artifact:", err)
+	if err := os.Chmod(f.Name(), 0644); err != nil {
 		return err
 	}
-	log.Println("Build complete")
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	fmt.Fprintf(conf.stdout(), "%s  %s\n", hex.EncodeToString(h.Sum(nil)), name)
 	return nil
 }
 
+// fetchEnv gets the server's environment, which determines what files it
+// needs for a build.
+func fetchEnv(serverURL string, client *http.Client) (*Env, error) {
+	url := serverURL + "/version?format=json"
+	log.Println("GET", url)
+	resp, err := client.Get(url)
+	if err != nil {
+		log.Println("Error making GET request:", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Println("Non-200 status code from version:", resp.StatusCode)
+		return nil, errStatusNot200
+	}
+	var env Env
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		log.Println("Could not decode /version JSON:", err)
+		return nil, err
+	}
+	log.Printf("Remote server has environment %+v", env)
+	return &env, nil
+}
+
+// downloadArtifacts downloads each of the binaries listed in the manifest of
+// a build of several packages or for several targets and returns their
+// hashes. The binaries of a build of several packages are written to the
+// directory conf.OutputName; otherwise, conf.OutputName is suffixed with
+// each target.
+func downloadArtifacts(conf *BuildConfig, client *http.Client, env *Env, id string, manifest *grb.BuildManifest) ([]string, error) {
+	if conf.PkgNames != nil {
+		if err := os.MkdirAll(conf.OutputName, 0755); err != nil {
+			return nil, err
+		}
+	}
+	var digests []string
+	for _, a := range manifest.Artifacts {
+		t := grb.Target{GOOS: a.GOOS, GOARCH: a.GOARCH}
+		if !requested(conf, env, a.Package, t) {
+			log.Printf("Build manifest lists %s for %s, which wasn't requested", a.Package, t)
+			return nil, errMetadataMismatch
+		}
+		path := t.BinaryName(conf.OutputName)
+		if conf.PkgNames != nil {
+			path = filepath.Join(conf.OutputName, filepath.Base(a.Name))
+		}
+		digest, err := fetchArtifact(conf, client, id, a, path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(conf.stdout(), "%s  %s\n", digest, path)
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+// fetchArtifact downloads a, one of the artifacts of the build with the given
+// ID, to path and returns its hash.
+func fetchArtifact(conf *BuildConfig, client *http.Client, id string, a grb.Artifact, path string) (string, error) {
+	url := conf.ServerURL + "/artifact/" + id + "/" + a.Name
+	log.Println("GET", url)
+	resp, err := client.Get(url)
+	if err != nil {
+		log.Println("Error making GET request:", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Println("Non-200 status code from /artifact:", resp.StatusCode)
+		return "", errStatusNot200
+	}
+	want := &grb.ArtifactMetadata{
+		BuildID: id,
+		Package: a.Package,
+		GOOS:    a.GOOS,
+		GOARCH:  a.GOARCH,
+		Flags:   conf.Flags,
+	}
+	digest, err := downloadArtifact(resp, path, conf.PublicKey, want)
+	if err != nil {
+		return "", err
+	}
+	if digest != a.SHA256 {
+		log.Printf("Got %s with SHA-256 %s; manifest says %s", a.Name, digest, a.SHA256)
+		return "", errArtifactMismatch
+	}
+	return digest, nil
+}
+
+// requested reports whether conf asked for pkg to be built for t.
+func requested(conf *BuildConfig, env *Env, pkg string, t grb.Target) bool {
+	pkgOK := pkg == conf.PkgName
+	for _, name := range conf.PkgNames {
+		pkgOK = pkgOK || pkg == name
+	}
+	targetOK := conf.Targets == nil && t.GOOS == env.GOOS && t.GOARCH == env.GOARCH
+	for _, target := range conf.Targets {
+		targetOK = targetOK || t == target
+	}
+	return pkgOK && targetOK
+}
+
+// reportTargets prints whether the build succeeded for each of targets.
+func reportTargets(targets []grb.Target, manifest *grb.BuildManifest) error {
+	failed := make(map[grb.Target]string)
+	for _, f := range manifest.Failures {
+		failed[f.Target] = f.Output
+	}
+	for _, t := range targets {
+		if out, ok := failed[t]; ok {
+			fmt.Fprintf(os.Stderr, "%s: FAILED\n%s", t, out)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: ok\n", t)
+	}
+	if len(failed) > 0 {
+		return errTargetsFailed
+	}
+	return nil
+}
+
+// downloadProvenance fetches the provenance of the build with the given ID,
+// which produced artifacts with the given hashes, and writes it to
+// conf.ProvenanceName.
+func downloadProvenance(conf *BuildConfig, client *http.Client, id string, hashes []string) error {
+	b, err := fetchBuildRecord(conf, client, "provenance", id)
+	if err != nil {
+		return err
+	}
+	var prov grb.Provenance
+	if err := json.Unmarshal(b, &prov); err != nil {
+		log.Println("Could not decode /provenance JSON:", err)
+		return err
+	}
+	provHashes := []string{prov.Artifact.SHA256}
+	if prov.Artifacts != nil {
+		provHashes = nil
+		for _, a := range prov.Artifacts {
+			provHashes = append(provHashes, a.SHA256)
+		}
+	}
+	if strings.Join(provHashes, " ") != strings.Join(hashes, " ") {
+		return fmt.Errorf("provenance is for artifacts with SHA-256 %s, not %s",
+			strings.Join(provHashes, ", "), strings.Join(hashes, ", "))
+	}
+	return ioutil.WriteFile(conf.ProvenanceName, b, 0644)
+}
+
+// fetchBuildRecord fetches a record that the server keeps about the build
+// with the given ID, such as its provenance, from /<kind>/<id>.
+func fetchBuildRecord(conf *BuildConfig, client *http.Client, kind, id string) ([]byte, error) {
+	url := conf.ServerURL + "/" + kind + "/" + id
+	log.Println("GET", url)
+	resp, err := client.Get(url)
+	if err != nil {
+		log.Println("Error making GET request:", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("Non-200 status code from /%s: %d", kind, resp.StatusCode)
+		return nil, errStatusNot200
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// currentUser returns the name of the user running grb, for the server's
+// records.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+var errArtifactMismatch = errors.New("downloaded artifact doesn't match the server's size or checksum")
+
+// downloadArtifact writes the artifact in the body of resp to path, checking
+// it against the size and SHA-256 hash sent by the server. If pubKey is
+// given, it also checks that the artifact was signed by the server and that
+// the signed metadata matches want (including its BuildID, the ID of the
+// build that the client requested). The artifact is downloaded to a
+// temporary file and only moved to path once all the checks pass.
+// It returns the hex SHA-256 hash of the artifact.
+func downloadArtifact(resp *http.Response, path string, pubKey ed25519.PublicKey, want *grb.ArtifactMetadata) (string, error) {
+	wantHash := resp.Header.Get(grb.SHA256Header)
+	if wantHash == "" || resp.ContentLength < 0 {
+		log.Println("Server did not send the artifact size and checksum")
+		return "", errArtifactMismatch
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".grb-download-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		// only needed in error cases
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	h := sha256.New()
+	n, err := io.Copy(f, io.TeeReader(resp.Body, h))
+	if err != nil {
+		log.Println("Error downloading file to disk:", err)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		log.Println("Error writing/closing output file:", err)
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	if n != resp.ContentLength || hash != wantHash {
+		log.Printf("Got %d bytes with SHA-256 %s; server sent %d bytes with SHA-256 %s",
+			n, hash, resp.ContentLength, wantHash)
+		return "", errArtifactMismatch
+	}
+	if pubKey != nil {
+		md, err := grb.VerifyArtifact(pubKey, hash, resp.Header)
+		if err != nil {
+			return "", err
+		}
+		// Checking the build ID rejects a replayed artifact from an
+		// earlier build, which may have used different sources.
+		if md.BuildID != want.BuildID || md.Package != want.Package ||
+			md.GOOS != want.GOOS || md.GOARCH != want.GOARCH ||
+			strings.Join(md.Flags, "\x00") != strings.Join(want.Flags, "\x00") {
+			log.Printf("Signed metadata %+v doesn't match the requested build", md)
+			return "", errMetadataMismatch
+		}
+		log.Printf("Verified signature (build %s, toolchain %s, built at %s)", md.BuildID, md.Toolchain, md.Time)
+	}
+	if err := os.Chmod(f.Name(), 0755); err != nil {
+		log.Println("Chmod error with output artifact:", err)
+		return "", err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+var errMetadataMismatch = errors.New("signed artifact metadata doesn't match the requested build")
+
 func uploadFile(file *grb.File, serverURL string, client *http.Client) error {
 	f, err := os.Open(file.LocalPath)
 	if err != nil {
@@ -303,14 +952,66 @@ func resolvePackage(dir, pkg, gopath string) (string, error) {
 }
 
 type grbConfig struct {
-	serverURL string
-	verbose   bool
-	out       string
-	race      bool
-	ldflags   string
-	pkg       string
-	gopath    string
-	dir       string // test hook
+	serverURL   string
+	verbose     bool
+	out         string
+	race        bool
+	msan        bool
+	asan        bool
+	a           bool
+	cover       bool
+	trimpath    bool
+	buildmode   string
+	buildvcs    stringBoolFlag
+	gcflags     string
+	asmflags    string
+	ldflags     string
+	tags        string // comma-separated, as for go build
+	pgo         string
+	env         listFlag // NAME=VALUE environment variables for the build
+	pkg         string
+	pkgs        []string // several packages or patterns, instead of pkg
+	targets     string   // comma-separated GOOS/GOARCH pairs
+	stdout      io.Writer
+	deb         debConfig
+	image       imageConfig
+	test        bool     // run the tests rather than building
+	testFlags   []string // passed to go test
+	testJSON    bool
+	run         bool     // run the binary on the server rather than downloading it
+	runArgs     []string // arguments for the binary
+	vet         bool     // vet the packages rather than building
+	vetJSON     bool
+	analyzers   []string // extra analyzers for vet
+	gopath      string
+	provenance  string
+	sbom        string
+	pubKey      string
+	vulnDB      string
+	vulnFail    bool
+	verify      bool
+	verifyLocal bool
+	dir         string // test hook
+}
+
+// debConfig holds the flags that describe a Debian package.
+type debConfig struct {
+	out         string
+	name        string
+	version     string
+	maintainer  string
+	description string
+	depends     string // comma-separated
+	dir         string
+	unit        string // file name of a systemd unit
+}
+
+// imageConfig holds the flags that describe an OCI image.
+type imageConfig struct {
+	out    string
+	ref    string
+	base   string // file name of a base layer
+	labels string // comma-separated key=value pairs
 }
 
 func runGRB(c grbConfig) error {
@@ -326,61 +1027,344 @@ func runGRB(c grbConfig) error {
 	if c.gopath != "" {
 		gopath = c.gopath
 	}
-	if strings.HasPrefix(pkgName, "/") || strings.HasPrefix(pkgName, ".") {
+	if (c.verify || c.verifyLocal) && !c.trimpath {
+		// Without -trimpath, each build records the directory it was
+		// built in, so the builds can't be identical.
+		return errors.New("can only verify a build with -trimpath")
+	}
+	var targets []grb.Target
+	if c.targets != "" {
+		if c.verify || c.verifyLocal {
+			return errors.New("can only verify a build for the server's platform")
+		}
 		var err error
-		pkgName, err = resolvePackage(c.dir, pkgName, gopath)
+		targets, err = parseTargets(c.targets)
 		if err != nil {
 			return err
 		}
 	}
-	pkgParts := strings.Split(pkgName, "/")
-	outputName := pkgParts[len(pkgParts)-1]
+	var pkgNames []string
+	outputName := "."
+	if c.pkgs != nil {
+		if c.verify || c.verifyLocal {
+			return errors.New("can only verify a build of a single package")
+		}
+		var err error
+		pkgNames, err = matchPackages(c.pkgs, c.dir, gopath, !c.test && !c.vet)
+		if err != nil {
+			return err
+		}
+		pkgName = ""
+	} else {
+		if strings.HasPrefix(pkgName, "/") || strings.HasPrefix(pkgName, ".") {
+			var err error
+			pkgName, err = resolvePackage(c.dir, pkgName, gopath)
+			if err != nil {
+				return err
+			}
+		}
+		pkgParts := strings.Split(pkgName, "/")
+		outputName = pkgParts[len(pkgParts)-1]
+	}
 	if c.out != "" {
 		outputName = c.out
 	}
 	var flags []string
-	if c.race {
-		flags = append(flags, "-race")
+	tags := parseTags(c.tags)
+	tagsFlag := strings.Join(tags, ",")
+	for _, f := range []struct {
+		name string
+		set  bool
+		tag  string // implied build tag
+	}{
+		{"a", c.a, ""},
+		{"race", c.race, "race"},
+		{"msan", c.msan, "msan"},
+		{"asan", c.asan, "asan"},
+		{"cover", c.cover, ""},
+		{"trimpath", c.trimpath, ""},
+	} {
+		if f.set {
+			flags = append(flags, "-"+f.name)
+			if f.tag != "" {
+				tags = append(tags, f.tag)
+			}
+		}
+	}
+	if c.buildvcs != "" {
+		flags = append(flags, "-buildvcs="+string(c.buildvcs))
+	}
+	for _, f := range []struct{ name, value string }{
+		{"buildmode", c.buildmode},
+		{"gcflags", c.gcflags},
+		{"asmflags", c.asmflags},
+		{"ldflags", c.ldflags},
+		{"tags", tagsFlag},
+	} {
+		if f.value != "" {
+			flags = append(flags, "-"+f.name, f.value)
+		}
+	}
+	if c.pgo == "auto" || c.pgo == "off" {
+		flags = append(flags, "-pgo", c.pgo)
+	} else if c.pgo != "" {
+		// The profile is sent as each main package's default.pgo, which
+		// the server uses by default.
+		if _, err := os.Stat(c.pgo); err != nil {
+			return err
+		}
+	}
+	if err := grb.CheckBuildFlags(flags); err != nil {
+		return err
+	}
+	var buildEnv map[string]string
+	// As with go build, cgo may be turned off in the environment.
+	if cgo := os.Getenv("CGO_ENABLED"); cgo != "" {
+		buildEnv = map[string]string{"CGO_ENABLED": cgo}
+	}
+	for _, kv := range c.env {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			return fmt.Errorf("malformed -env %q (want NAME=VALUE)", kv)
+		}
+		if buildEnv == nil {
+			buildEnv = make(map[string]string)
+		}
+		buildEnv[kv[:i]] = kv[i+1:]
+	}
+	var deb *grb.DebPackage
+	if c.deb.out != "" {
+		if pkgNames != nil || targets != nil || c.verify || c.verifyLocal {
+			return errors.New("can only make a Debian package from a build of a single package for the server's platform")
+		}
+		var err error
+		deb, err = newDebPackage(c.deb, filepath.Base(outputName))
+		if err != nil {
+			return err
+		}
+	}
+	var img *grb.Image
+	if c.image.out != "" {
+		if pkgNames != nil || targets != nil || c.verify || c.verifyLocal {
+			return errors.New("can only make an image from a build of a single package for the server's platform")
+		}
+		var err error
+		img, err = newImage(c.image, pkgName, filepath.Base(outputName))
+		if err != nil {
+			return err
+		}
+	}
+	var pubKey ed25519.PublicKey
+	if c.pubKey != "" {
+		var err error
+		pubKey, err = grb.DecodePublicKey(c.pubKey)
+		if err != nil {
+			return err
+		}
 	}
-	if c.ldflags != "" {
-		flags = append(flags, "-ldflags", c.ldflags)
+	var vulnDB *grb.VulnDB
+	if c.vulnDB != "" {
+		var err error
+		vulnDB, err = grb.LoadVulnDB(c.vulnDB)
+		if err != nil {
+			return err
+		}
 	}
 	conf := &BuildConfig{
-		PkgName:    pkgName,
-		ServerURL:  c.serverURL,
-		OutputName: outputName,
-		Flags:      flags,
-		GOPATH:     c.gopath,
+		PkgName:        pkgName,
+		PkgNames:       pkgNames,
+		Targets:        targets,
+		Stdout:         c.stdout,
+		DebName:        c.deb.out,
+		Deb:            deb,
+		ImageName:      c.image.out,
+		Image:          img,
+		ServerURL:      c.serverURL,
+		OutputName:     outputName,
+		ProvenanceName: c.provenance,
+		SBOMName:       c.sbom,
+		Flags:          flags,
+		Find:           FindOptions{Tags: tags, PGO: c.pgo, Env: buildEnv},
+		GOPATH:         c.gopath,
+		PublicKey:      pubKey,
+		VulnDB:         vulnDB,
+		FailOnVulns:    c.vulnFail,
+		Verify:         c.verify || c.verifyLocal,
+		VerifyLocal:    c.verifyLocal,
+		Test:           c.test,
+		TestFlags:      c.testFlags,
+		TestJSON:       c.testJSON,
+		Run:            c.run,
+		RunArgs:        c.runArgs,
+		Vet:            c.vet,
+		VetJSON:        c.vetJSON,
+		Analyzers:      c.analyzers,
 	}
 	return runBuild(conf)
 }
 
+// newDebPackage creates the description of a Debian package from the flags
+// in dc. The package name defaults to the name of the binary.
+func newDebPackage(dc debConfig, bin string) (*grb.DebPackage, error) {
+	deb := &grb.DebPackage{
+		Name:        dc.name,
+		Binary:      bin,
+		Version:     dc.version,
+		Maintainer:  dc.maintainer,
+		Description: dc.description,
+		InstallDir:  dc.dir,
+	}
+	if deb.Name == "" {
+		deb.Name = bin
+	}
+	if dc.depends != "" {
+		for _, dep := range strings.Split(dc.depends, ",") {
+			deb.Depends = append(deb.Depends, strings.TrimSpace(dep))
+		}
+	}
+	if dc.unit != "" {
+		var err error
+		deb.Unit, err = ioutil.ReadFile(dc.unit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deb, nil
+}
+
+// newImage creates the description of an image holding the binary bin, built
+// from pkgName, from the flags in ic.
+func newImage(ic imageConfig, pkgName, bin string) (*grb.Image, error) {
+	img := &grb.Image{
+		Ref:        ic.ref,
+		BinaryPath: "/usr/local/bin/" + bin,
+		Labels:     map[string]string{"org.opencontainers.image.title": pkgName},
+	}
+	if img.Ref == "" {
+		img.Ref = bin + ":latest"
+	}
+	if ic.labels != "" {
+		for _, label := range strings.Split(ic.labels, ",") {
+			kv := strings.SplitN(label, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("malformed image label %q (want key=value)", label)
+			}
+			img.Labels[strings.TrimSpace(kv[0])] = kv[1]
+		}
+	}
+	if ic.base != "" {
+		var err error
+		img.BaseLayer, err = ioutil.ReadFile(ic.base)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// addBuildFlags adds the flags shared by grb and its subcommands to fs.
+func addBuildFlags(fs *flag.FlagSet, c *grbConfig) {
+	fs.BoolVar(&c.a, "a", false, "build with -a flag")
+	fs.BoolVar(&c.race, "race", false, "build with -race flag")
+	fs.BoolVar(&c.msan, "msan", false, "build with -msan flag")
+	fs.BoolVar(&c.asan, "asan", false, "build with -asan flag")
+	fs.BoolVar(&c.cover, "cover", false, "build with -cover flag")
+	fs.BoolVar(&c.trimpath, "trimpath", false, "build with -trimpath flag")
+	fs.StringVar(&c.buildmode, "buildmode", "", "build with -buildmode flag")
+	fs.Var(&c.buildvcs, "buildvcs", "build with -buildvcs flag")
+	fs.StringVar(&c.gcflags, "gcflags", "", "build with -gcflags flag")
+	fs.StringVar(&c.asmflags, "asmflags", "", "build with -asmflags flag")
+	fs.StringVar(&c.ldflags, "ldflags", "", "build with -ldflags flag")
+	fs.StringVar(&c.tags, "tags", "", "build with -tags flag (a comma-separated list of build tags)")
+	fs.StringVar(&c.pgo, "pgo", "", "build with -pgo flag (a profile is sent to the server as default.pgo)")
+	fs.Var(&c.env, "env", "set the environment variable NAME=VALUE (CGO_ENABLED, CGO_CFLAGS, CGO_LDFLAGS, or CC, as far as the server allows) for the build; may be repeated (CGO_ENABLED is also taken from the environment)")
+	fs.BoolVar(&c.verbose, "v", false, "show logging messages")
+	fs.StringVar(&c.pubKey, "pubkey", os.Getenv("GRB_SERVER_PUBKEY"), "require artifacts to be signed by the server's key, given in base64 (default $GRB_SERVER_PUBKEY)")
+	fs.StringVar(&c.vulnDB, "vulndb", "", "check the packages in the build against the Go vulnerability database snapshot in this directory")
+	fs.BoolVar(&c.vulnFail, "vulnfail", false, "fail if -vulndb finds packages with known vulnerabilities")
+}
+
+// A stringBoolFlag is a flag, like go build's -buildvcs, that may be given
+// without a value to mean true.
+type stringBoolFlag string
+
+func (f *stringBoolFlag) String() string     { return string(*f) }
+func (f *stringBoolFlag) Set(s string) error { *f = stringBoolFlag(s); return nil }
+func (f *stringBoolFlag) IsBoolFlag() bool   { return true }
+
+// A listFlag is a flag that may be repeated to give a list of values.
+type listFlag []string
+
+func (f *listFlag) String() string     { return strings.Join(*f, " ") }
+func (f *listFlag) Set(s string) error { *f = append(*f, s); return nil }
+
+// serverURL returns the URL of the build server from the environment.
+func serverURL() string {
+	url := os.Getenv("GRB_SERVER_URL")
+	if url == "" {
+		log.Fatal("Must provide environment variable GRB_SERVER_URL.")
+	}
+	return url
+}
+
 func main() {
+	log.SetFlags(log.Lmicroseconds)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "release":
+			releaseMain(os.Args[2:])
+			return
+		case "test":
+			testMain(os.Args[2:])
+			return
+		case "run":
+			runMain(os.Args[2:])
+			return
+		case "vet":
+			vetMain(os.Args[2:])
+			return
+		}
+	}
+
 	var c grbConfig
-	flag.StringVar(&c.out, "o", "", "specify output file name")
-	flag.BoolVar(&c.race, "race", false, "build with -race flag")
-	flag.StringVar(&c.ldflags, "ldflags", "", "build with -ldflags flag")
-	flag.BoolVar(&c.verbose, "v", false, "show logging messages")
+	addBuildFlags(flag.CommandLine, &c)
+	flag.StringVar(&c.out, "o", "", "specify output file name (or directory, when building several packages)")
+	flag.StringVar(&c.targets, "targets", "", "build for this comma-separated list of GOOS/GOARCH platforms rather than the server's (each output gets a _GOOS_GOARCH suffix)")
+	flag.StringVar(&c.provenance, "provenance", "", "write the provenance of the build (a JSON record of its inputs and settings) to this file")
+	flag.StringVar(&c.sbom, "sbom", "", "write a software bill of materials for the build (in CycloneDX JSON format) to this file")
+	flag.StringVar(&c.deb.out, "deb", "", "also package the binary as a Debian package with this file name")
+	flag.StringVar(&c.deb.name, "debname", "", "name of the Debian package (default the name of the binary)")
+	flag.StringVar(&c.deb.version, "debversion", "", "version of the Debian package")
+	flag.StringVar(&c.deb.maintainer, "debmaintainer", "", "maintainer of the Debian package, as in \"Name <email>\"")
+	flag.StringVar(&c.deb.description, "debdescription", "", "one-line description of the Debian package")
+	flag.StringVar(&c.deb.depends, "debdepends", "", "comma-separated dependencies of the Debian package")
+	flag.StringVar(&c.deb.dir, "debdir", "/usr/bin", "directory in which the Debian package installs the binary")
+	flag.StringVar(&c.deb.unit, "debunit", "", "systemd unit file to include in the Debian package (installed as NAME.service)")
+	flag.StringVar(&c.image.out, "image", "", "also package the binary as a container image, written to this file as a tarball in the OCI image layout format")
+	flag.StringVar(&c.image.ref, "imageref", "", "name of the image in the layout (default BINARY:latest)")
+	flag.StringVar(&c.image.base, "imagebase", "", "layer (a tar or tar.gz file) to put beneath the binary in the image, which is otherwise empty")
+	flag.StringVar(&c.image.labels, "imagelabels", "", "comma-separated key=value labels for the image")
+	flag.BoolVar(&c.verify, "verify", false, "build twice on the server and check that the results are identical, rather than downloading the result (requires -trimpath)")
+	flag.BoolVar(&c.verifyLocal, "verifylocal", false, "like -verify, but also compare with a local go build of the files sent to the server")
 	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, `usage: grb [flags] [package]
+		fmt.Fprint(os.Stderr, `usage: grb [flags] [packages]
+       grb release [flags] [packages]
+       grb test [flags] [packages] [test flags]
+       grb run [flags] [package] [-- args]
+       grb vet [flags] [packages]
 
 where the flags are:
 `)
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	switch flag.NArg() {
-	case 0:
-	case 1:
+	switch {
+	case flag.NArg() == 1 && !strings.Contains(flag.Arg(0), "..."):
 		c.pkg = flag.Arg(0)
-	default:
-		flag.Usage()
-	}
-	log.SetFlags(log.Lmicroseconds)
-	c.serverURL = os.Getenv("GRB_SERVER_URL")
-	if c.serverURL == "" {
-		log.Fatal("Must provide environment variable GRB_SERVER_URL.")
+	case flag.NArg() > 0:
+		c.pkgs = flag.Args()
 	}
+	c.serverURL = serverURL()
 
 	if err := runGRB(c); err != nil {
 		log.Fatalln("Fatal error:", err)
@@ -1,22 +1,60 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cespare/grb/internal/grb"
 )
 
+// testGOCACHE is a server build cache that tests needing a warm cache
+// share; see shareGOCACHE.
+var testGOCACHE string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir(".", "test-gocache-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	testGOCACHE, err = filepath.Abs(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 type testGRB struct {
-	t      *testing.T
-	tmp    string
-	gopath string
-	server *httptest.Server
+	t         *testing.T
+	tmp       string
+	dataDir   string
+	gopath    string
+	grbServer *grb.Server
+	server    *httptest.Server
 }
 
 func newTestGRB(t *testing.T) *testGRB {
@@ -24,7 +62,8 @@ func newTestGRB(t *testing.T) *testGRB {
 	if err != nil {
 		t.Fatal(err)
 	}
-	server, err := grb.NewServer(filepath.Join(tmp, "data"), "")
+	dataDir := filepath.Join(tmp, "data")
+	server, err := grb.NewServer(dataDir, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -33,10 +72,22 @@ func newTestGRB(t *testing.T) *testGRB {
 		t.Fatal(err)
 	}
 	return &testGRB{
-		t:      t,
-		tmp:    tmp,
-		gopath: gopath,
-		server: httptest.NewServer(server),
+		t:         t,
+		tmp:       tmp,
+		dataDir:   dataDir,
+		gopath:    gopath,
+		grbServer: server,
+		server:    httptest.NewServer(server),
+	}
+}
+
+// shareGOCACHE makes the server use the build cache shared between tests
+// rather than its own, empty one. Tests that run many builds use it to
+// avoid rebuilding the standard library each time.
+func (tg *testGRB) shareGOCACHE() {
+	tg.t.Helper()
+	if err := os.Symlink(testGOCACHE, filepath.Join(tg.dataDir, "gocache")); err != nil {
+		tg.t.Fatal(err)
 	}
 }
 
@@ -59,6 +110,25 @@ func (tg *testGRB) build(dir, pkg, bin string) {
 	}
 }
 
+// findFiles returns the files, named as package/file, that grb sends to the
+// server to build pkg for the local platform.
+func (tg *testGRB) findFiles(pkg string, opts *FindOptions) []string {
+	tg.t.Helper()
+	env := &Env{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}
+	pkgs, err := FindPackages([]string{pkg}, env, tg.gopath, opts)
+	if err != nil {
+		tg.t.Fatal(err)
+	}
+	var files []string
+	for _, p := range pkgs {
+		for _, file := range p.Files {
+			files = append(files, p.Name+"/"+file.Name)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
 func (tg *testGRB) run(bin string) string {
 	tg.t.Helper()
 	out, err := exec.Command(bin).Output()
@@ -78,6 +148,15 @@ func TestHello(t *testing.T) {
 	if want := "a"; got != want {
 		t.Fatalf("got %q; want %q", got, want)
 	}
+
+	// The server keeps a build cache for its toolchain.
+	caches, err := filepath.Glob(filepath.Join(tg.dataDir, "gocache", "go*", "??"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caches) == 0 {
+		t.Fatal("server has no GOCACHE after build")
+	}
 }
 
 func TestVendor(t *testing.T) {
@@ -112,3 +191,1224 @@ func TestRelative(t *testing.T) {
 		}
 	}
 }
+
+func TestOverlay(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.grbServer.Overlay = true
+
+	for _, tt := range []struct {
+		pkg  string
+		want string
+	}{
+		{"hello", "a"},
+		{"v", "a vendored"},
+	} {
+		bin := filepath.Join(tg.tmp, tt.pkg)
+		tg.build("", tt.pkg, bin)
+		if got := tg.run(bin); got != tt.want {
+			t.Fatalf("got %q; want %q", got, tt.want)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+
+	for _, tt := range []struct {
+		tags string
+		want string
+	}{
+		{"", "plain"},
+		// The tagged file imports a, which must be sent too.
+		{"fancy", "fancy a"},
+		{"other,fancy", "fancy a"},
+		{"other fancy", "fancy a"},
+	} {
+		bin := filepath.Join(tg.tmp, "tagged")
+		c := grbConfig{
+			serverURL: tg.server.URL,
+			out:       bin,
+			pkg:       "tagged",
+			gopath:    tg.gopath,
+			tags:      tt.tags,
+		}
+		if err := runGRB(c); err != nil {
+			t.Fatalf("-tags %q: %s", tt.tags, err)
+		}
+		if got := tg.run(bin); got != tt.want {
+			t.Fatalf("-tags %q: got %q; want %q", tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.shareGOCACHE()
+
+	c := grbConfig{
+		serverURL:   tg.server.URL,
+		pkg:         "hello",
+		gopath:      tg.gopath,
+		verifyLocal: true,
+	}
+	// Without -trimpath, each build records its GOPATH, so they can't be
+	// identical.
+	if err := runGRB(c); err == nil || !strings.Contains(err.Error(), "-trimpath") {
+		t.Fatalf("without -trimpath: got err=%v", err)
+	}
+	// With it, the server's builds and the local build of the uploaded
+	// files are identical.
+	for _, pkg := range []string{"hello", "embedded"} {
+		var out bytes.Buffer
+		c.pkg = pkg
+		c.trimpath = true
+		c.stdout = &out
+		if err := runGRB(c); err != nil {
+			t.Fatalf("%s: %s", pkg, err)
+		}
+		if !strings.Contains(out.String(), "Builds are identical\n") {
+			t.Errorf("%s: got output:\n%s", pkg, out.String())
+		}
+	}
+}
+
+func TestBuildFlags(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.shareGOCACHE()
+
+	// Each build on the server matches a local go build with the same
+	// flags.
+	env := &Env{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}
+	for _, tt := range []struct {
+		c    grbConfig
+		args []string // for go build
+	}{
+		{grbConfig{pkg: "hello"}, nil},
+		{grbConfig{pkg: "hello", gcflags: "hello=-N -l"}, []string{"-gcflags=hello=-N -l"}},
+		{grbConfig{pkg: "hello", ldflags: "-s -w -X 'main.unused=a b'"}, []string{"-ldflags", "-s -w -X 'main.unused=a b'"}},
+		{grbConfig{pkg: "hello", buildvcs: "false"}, []string{"-buildvcs=false"}},
+		{grbConfig{pkg: "hello", cover: true}, []string{"-cover"}},
+		{grbConfig{pkg: "tagged", tags: "fancy"}, []string{"-tags", "fancy"}},
+		{grbConfig{pkg: "pgo"}, nil},
+	} {
+		c := tt.c
+		c.serverURL = tg.server.URL
+		c.gopath = tg.gopath
+		c.trimpath = true
+		c.out = filepath.Join(tg.tmp, "remote")
+		if err := runGRB(c); err != nil {
+			t.Fatalf("%s %q: %s", c.pkg, tt.args, err)
+		}
+		local := filepath.Join(tg.tmp, "local")
+		args := append([]string{"-trimpath"}, tt.args...)
+		if err := localBuild(c.pkg, env, tg.gopath, args, nil, local); err != nil {
+			t.Fatal(err)
+		}
+		remoteBin, err := ioutil.ReadFile(c.out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		localBin, err := ioutil.ReadFile(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(remoteBin, localBin) {
+			t.Errorf("%s %q: server build differs from local build", c.pkg, tt.args)
+		}
+	}
+
+	// Flags that could write files on the server, or run other programs,
+	// aren't allowed.
+	for _, c := range []grbConfig{
+		{gcflags: "-cpuprofile=/tmp/cpu.out"},
+		{ldflags: "-linkmode=external -extld=/bin/sh"},
+		{asmflags: "-o /tmp/x.o"},
+		{buildmode: "shared"},
+	} {
+		c.serverURL = tg.server.URL
+		c.gopath = tg.gopath
+		c.pkg = "hello"
+		c.out = filepath.Join(tg.tmp, "hello")
+		if err := runGRB(c); err == nil {
+			t.Errorf("%+v: got no error", c)
+		}
+	}
+}
+
+func TestPGO(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.shareGOCACHE()
+
+	profile := filepath.Join(tg.tmp, "cpu.pprof")
+	b, err := ioutil.ReadFile("testdata/src/pgo/default.pgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(profile, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, overlay := range []bool{false, true} {
+		tg.grbServer.Overlay = overlay
+		for _, tt := range []struct {
+			pkg  string
+			pgo  string
+			want string // the -pgo build setting
+		}{
+			{"pgo", "", "default.pgo"},
+			{"pgo", "off", ""},
+			{"hello", "", ""},
+			{"hello", profile, "default.pgo"},
+		} {
+			bin := filepath.Join(tg.tmp, tt.pkg)
+			c := grbConfig{
+				serverURL: tg.server.URL,
+				out:       bin,
+				pkg:       tt.pkg,
+				gopath:    tg.gopath,
+				trimpath:  true,
+				pgo:       tt.pgo,
+			}
+			if err := runGRB(c); err != nil {
+				t.Fatalf("%s -pgo=%s: %s", tt.pkg, tt.pgo, err)
+			}
+			info, err := buildinfo.ReadFile(bin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			for _, setting := range info.Settings {
+				if setting.Key == "-pgo" {
+					got = setting.Value
+				}
+			}
+			if got != tt.want {
+				t.Errorf("%s -pgo=%s (overlay=%t): got -pgo setting %q; want %q", tt.pkg, tt.pgo, overlay, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.shareGOCACHE()
+	tg.grbServer.BuildEnv["CGO_CFLAGS"] = nil
+
+	bin := filepath.Join(tg.tmp, "cgoenv")
+	build := func(env ...string) error {
+		c := grbConfig{
+			serverURL: tg.server.URL,
+			out:       bin,
+			pkg:       "cgoenv",
+			gopath:    tg.gopath,
+			env:       env,
+		}
+		return runGRB(c)
+	}
+	for _, tt := range []struct {
+		env  []string
+		want string
+	}{
+		{nil, "cgo 0"},
+		{[]string{"CGO_CFLAGS=-DANSWER=42"}, "cgo 42"},
+		// Without cgo, the other file, and the package it imports, are
+		// needed.
+		{[]string{"CGO_ENABLED=0"}, "no cgo a"},
+	} {
+		if err := build(tt.env...); err != nil {
+			t.Fatalf("%q: %s", tt.env, err)
+		}
+		if got := tg.run(bin); got != tt.want {
+			t.Fatalf("%q: got %q; want %q", tt.env, got, tt.want)
+		}
+	}
+
+	// CGO_ENABLED is taken from the environment, as with go build.
+	t.Setenv("CGO_ENABLED", "0")
+	if err := build(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tg.run(bin), "no cgo a"; got != want {
+		t.Fatalf("with CGO_ENABLED=0 in the environment: got %q; want %q", got, want)
+	}
+
+	// The server's policy limits the variables and values.
+	for _, env := range []string{"CC=/bin/sh", "CGO_ENABLED=2", "GOFLAGS=-toolexec=sh", "CGO_ENABLED"} {
+		if err := build(env); err == nil {
+			t.Errorf("-env %q: got no error", env)
+		}
+	}
+}
+
+func TestCgoHeaders(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+
+	// cinc includes headers from ../ccommon and, through a -I directory in
+	// a #cgo directive, ../cinclude (which includes another from a
+	// subdirectory).
+	got := tg.findFiles("cinc", &FindOptions{})
+	want := []string{
+		"ccommon/common.h",
+		"cinc/helper.c",
+		"cinc/main.go",
+		"cinclude/answer.h",
+		"cinclude/sub/forty.h",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got files %q; want %q", got, want)
+	}
+
+	for _, overlay := range []bool{false, true} {
+		tg.grbServer.Overlay = overlay
+		bin := filepath.Join(tg.tmp, "cinc")
+		tg.build("", "cinc", bin)
+		if got, want := tg.run(bin), "1 42 2"; got != want {
+			t.Fatalf("overlay=%t: got %q; want %q", overlay, got, want)
+		}
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+
+	got := tg.findFiles("embedded", &FindOptions{})
+	// Files in embedded directories that begin with . or _ are skipped,
+	// except with all:.
+	want := []string{
+		"embedded/greeting.txt",
+		"embedded/hidden/.dot",
+		"embedded/main.go",
+		"embedded/static/a.txt",
+		"embedded/static/sub/b.txt",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got files %q; want %q", got, want)
+	}
+
+	for _, overlay := range []bool{false, true} {
+		tg.grbServer.Overlay = overlay
+		bin := filepath.Join(tg.tmp, "embedded")
+		tg.build("", "embedded", bin)
+		want := "hello\nstatic/a.txt\nstatic/sub/b.txt\nhidden/.dot"
+		if got := tg.run(bin); got != want {
+			t.Fatalf("overlay=%t: got %q; want %q", overlay, got, want)
+		}
+	}
+}
+
+func TestFileSelection(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+
+	// Only the files needed for the build's platform, tags, and cgo
+	// setting are sent.
+	for _, tt := range []struct {
+		pkg  string
+		opts FindOptions
+		want []string
+	}{
+		{"racy", FindOptions{}, []string{"racy/main.go", "racy/norace.go"}},
+		{"racy", FindOptions{Tags: []string{"race"}}, []string{"racy/main.go", "racy/race.go"}},
+		{"tagged", FindOptions{}, []string{"tagged/main.go", "tagged/plain.go"}},
+		{
+			"cgoenv",
+			FindOptions{Env: map[string]string{"CGO_ENABLED": "1"}},
+			[]string{"cgoenv/cgo.go", "cgoenv/main.go"},
+		},
+		{
+			"cgoenv",
+			FindOptions{Env: map[string]string{"CGO_ENABLED": "0"}},
+			[]string{"a/a.go", "cgoenv/main.go", "cgoenv/nocgo.go"},
+		},
+	} {
+		if got := tg.findFiles(tt.pkg, &tt.opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s with %+v: got files %q; want %q", tt.pkg, tt.opts, got, tt.want)
+		}
+	}
+	if runtime.GOOS == "linux" {
+		got := tg.findFiles("plat", &FindOptions{})
+		if want := []string{"plat/main.go", "plat/os_linux.go"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("plat: got files %q; want %q", got, want)
+		}
+	}
+}
+
+func TestRace(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.shareGOCACHE()
+
+	bin := filepath.Join(tg.tmp, "racy")
+	for _, race := range []bool{false, true} {
+		c := grbConfig{
+			serverURL: tg.server.URL,
+			out:       bin,
+			pkg:       "racy",
+			gopath:    tg.gopath,
+			race:      race,
+		}
+		if err := runGRB(c); err != nil {
+			t.Fatalf("race=%t: %s", race, err)
+		}
+		want := "norace"
+		if race {
+			want = "race"
+		}
+		if got := tg.run(bin); got != want {
+			t.Fatalf("race=%t: got %q; want %q", race, got, want)
+		}
+	}
+}
+
+// corruptingHandler flips a bit in the body of successful /build responses.
+type corruptingHandler struct {
+	h http.Handler
+}
+
+func (c corruptingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/build/") {
+		c.h.ServeHTTP(w, r)
+		return
+	}
+	rec := httptest.NewRecorder()
+	c.h.ServeHTTP(rec, r)
+	body := rec.Body.Bytes()
+	if rec.Code == 200 {
+		body[len(body)/2] ^= 1
+	}
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.Code)
+	w.Write(body)
+}
+
+func TestCorruptArtifact(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	server := httptest.NewServer(corruptingHandler{tg.grbServer})
+	defer server.Close()
+
+	bin := filepath.Join(tg.tmp, "hello")
+	c := grbConfig{
+		serverURL: server.URL,
+		out:       bin,
+		pkg:       "hello",
+		gopath:    tg.gopath,
+	}
+	if err := runGRB(c); err != errArtifactMismatch {
+		t.Fatalf("got err=%v; want %v", err, errArtifactMismatch)
+	}
+	if _, err := os.Stat(bin); !os.IsNotExist(err) {
+		t.Fatalf("corrupt output file was not removed (stat err=%v)", err)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	key, err := grb.GenerateSigningKey(filepath.Join(tg.tmp, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.grbServer.SigningKey = key
+	otherKey, err := grb.GenerateSigningKey(filepath.Join(tg.tmp, "other.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bin := filepath.Join(tg.tmp, "hello")
+	c := grbConfig{
+		serverURL: tg.server.URL,
+		out:       bin,
+		pkg:       "hello",
+		gopath:    tg.gopath,
+		pubKey:    grb.EncodePublicKey(otherKey.Public().(ed25519.PublicKey)),
+	}
+	if err := runGRB(c); err != grb.ErrBadSignature {
+		t.Fatalf("with wrong key: got err=%v; want %v", err, grb.ErrBadSignature)
+	}
+	if _, err := os.Stat(bin); !os.IsNotExist(err) {
+		t.Fatalf("output file was written despite bad signature (stat err=%v)", err)
+	}
+
+	resp, err := http.Get(tg.server.URL + "/pubkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.pubKey = string(b)
+	if err := runGRB(c); err != nil {
+		t.Fatalf("with server's key: %s", err)
+	}
+	if got, want := tg.run(bin), "a"; got != want {
+		t.Fatalf("got %q; want %q", got, want)
+	}
+}
+
+// replayingHandler answers every /build request with the response to the
+// first one.
+type replayingHandler struct {
+	h   http.Handler
+	mu  sync.Mutex
+	rec *httptest.ResponseRecorder
+}
+
+func (rh *replayingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/build/") {
+		rh.h.ServeHTTP(w, r)
+		return
+	}
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	if rh.rec == nil {
+		rh.rec = httptest.NewRecorder()
+		rh.h.ServeHTTP(rh.rec, r)
+	}
+	for k, v := range rh.rec.Header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rh.rec.Code)
+	w.Write(rh.rec.Body.Bytes())
+}
+
+func TestSignatureReplay(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	key, err := grb.GenerateSigningKey(filepath.Join(tg.tmp, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.grbServer.SigningKey = key
+	server := httptest.NewServer(&replayingHandler{h: tg.grbServer})
+	defer server.Close()
+
+	bin := filepath.Join(tg.tmp, "hello")
+	c := grbConfig{
+		serverURL: server.URL,
+		out:       bin,
+		pkg:       "hello",
+		gopath:    tg.gopath,
+		pubKey:    grb.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+	}
+	if err := runGRB(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(bin); err != nil {
+		t.Fatal(err)
+	}
+	// The second build gets the first build's validly signed artifact.
+	if err := runGRB(c); err != errMetadataMismatch {
+		t.Fatalf("with replayed artifact: got err=%v; want %v", err, errMetadataMismatch)
+	}
+	if _, err := os.Stat(bin); !os.IsNotExist(err) {
+		t.Fatalf("output file was written despite replayed artifact (stat err=%v)", err)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+
+	bin := filepath.Join(tg.tmp, "hello")
+	provName := filepath.Join(tg.tmp, "hello.provenance.json")
+	c := grbConfig{
+		serverURL:  tg.server.URL,
+		out:        bin,
+		pkg:        "hello",
+		gopath:     tg.gopath,
+		provenance: provName,
+	}
+	if err := runGRB(c); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(provName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prov grb.Provenance
+	if err := json.Unmarshal(b, &prov); err != nil {
+		t.Fatal(err)
+	}
+	if prov.Package != "hello" || prov.Toolchain == "" || prov.User == "" || prov.Finished.Before(prov.Started) {
+		t.Errorf("bad provenance: %+v", prov)
+	}
+	var inputs []string
+	for _, pkg := range prov.Inputs {
+		for _, file := range pkg.Files {
+			inputs = append(inputs, pkg.Name+"/"+file.Name)
+			if file.LocalPath != "" || len(file.Hash) != 64 {
+				t.Errorf("bad input file %+v", file)
+			}
+		}
+	}
+	if got, want := strings.Join(inputs, " "), "a/a.go hello/hello.go"; got != want {
+		t.Errorf("got inputs %q; want %q", got, want)
+	}
+}
+
+func TestSBOM(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+
+	sbomName := filepath.Join(tg.tmp, "v.sbom.json")
+	c := grbConfig{
+		serverURL: tg.server.URL,
+		out:       filepath.Join(tg.tmp, "v"),
+		pkg:       "v",
+		gopath:    tg.gopath,
+		sbom:      sbomName,
+	}
+	if err := runGRB(c); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(sbomName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sbom grb.SBOM
+	if err := json.Unmarshal(b, &sbom); err != nil {
+		t.Fatal(err)
+	}
+	if sbom.BOMFormat != "CycloneDX" || sbom.Metadata.Component.Name != "v" {
+		t.Fatalf("bad SBOM: %s", b)
+	}
+	var components []string
+	for _, c := range sbom.Components {
+		for _, f := range c.Components {
+			components = append(components, c.Name+":"+f.Name)
+			if len(f.Hashes) != 1 || f.Hashes[0].Alg != "SHA-256" {
+				t.Errorf("bad hashes for %s: %+v", f.Name, f.Hashes)
+			}
+		}
+	}
+	// The vendored package is listed by its import path.
+	if got, want := strings.Join(components, " "), "a:a.go v:v.go"; got != want {
+		t.Fatalf("got components %q; want %q", got, want)
+	}
+}
+
+func TestVulnDB(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	db, err := grb.LoadVulnDB("testdata/vulndb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// By default, vulnerabilities are only reported.
+	tg.grbServer.VulnDB = db
+	tg.build("", "hello", filepath.Join(tg.tmp, "hello"))
+
+	// a has a vulnerability in some versions, but its version isn't
+	// known, so the build isn't refused.
+	tg.grbServer.FailOnVulns = true
+	tg.build("", "hello", filepath.Join(tg.tmp, "hello"))
+
+	// multi/lib is vulnerable in every version.
+	c := grbConfig{
+		serverURL: tg.server.URL,
+		out:       filepath.Join(tg.tmp, "bar"),
+		pkg:       "multi/cmd/bar",
+		gopath:    tg.gopath,
+	}
+	if err := runGRB(c); err != errStatusNot200 {
+		t.Fatalf("with server policy: got err=%v; want %v", err, errStatusNot200)
+	}
+
+	// The client can check too.
+	tg.grbServer.VulnDB = nil
+	c.vulnDB = "testdata/vulndb"
+	c.vulnFail = true
+	if err := runGRB(c); err != errVulnerable {
+		t.Fatalf("with client policy: got err=%v; want %v", err, errVulnerable)
+	}
+}
+
+func TestMultiple(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.shareGOCACHE()
+	key, err := grb.GenerateSigningKey(filepath.Join(tg.tmp, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.grbServer.SigningKey = key
+
+	out := filepath.Join(tg.tmp, "bin")
+	provName := filepath.Join(tg.tmp, "provenance.json")
+	c := grbConfig{
+		serverURL:  tg.server.URL,
+		out:        out,
+		pkgs:       []string{"./multi/...", "hello"},
+		gopath:     tg.gopath,
+		dir:        "testdata/src",
+		provenance: provName,
+		pubKey:     grb.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+	}
+	if err := runGRB(c); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		bin  string
+		want string
+	}{
+		{"foo", "foo a"},
+		{"bar", "bar lib"},
+		{"hello", "a"},
+	} {
+		if got := tg.run(filepath.Join(out, tt.bin)); got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.bin, got, tt.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "lib")); !os.IsNotExist(err) {
+		t.Errorf("non-command package was written (stat err=%v)", err)
+	}
+
+	b, err := ioutil.ReadFile(provName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prov grb.Provenance
+	if err := json.Unmarshal(b, &prov); err != nil {
+		t.Fatal(err)
+	}
+	var pkgs []string
+	for _, a := range prov.Artifacts {
+		pkgs = append(pkgs, a.Package)
+	}
+	if got, want := strings.Join(pkgs, " "), "multi/cmd/bar multi/cmd/foo hello"; got != want {
+		t.Errorf("got provenance for %q; want %q", got, want)
+	}
+
+	c.pkgs = []string{"nothing/..."}
+	if err := runGRB(c); err == nil {
+		t.Fatal("got no error for a pattern matching no packages")
+	}
+}
+
+func TestTargets(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.shareGOCACHE()
+
+	// plat doesn't build for darwin.
+	out := filepath.Join(tg.tmp, "plat")
+	c := grbConfig{
+		serverURL: tg.server.URL,
+		out:       out,
+		pkg:       "plat",
+		gopath:    tg.gopath,
+		targets:   "linux/amd64,windows/amd64,darwin/amd64",
+	}
+	if err := runGRB(c); err != errTargetsFailed {
+		t.Fatalf("got err=%v; want %v", err, errTargetsFailed)
+	}
+	if runtime.GOOS == "linux" && runtime.GOARCH == "amd64" {
+		if got, want := tg.run(out+"_linux_amd64"), "linux"; got != want {
+			t.Fatalf("got %q; want %q", got, want)
+		}
+	}
+	// The windows-only file was uploaded too.
+	b, err := ioutil.ReadFile(out + "_windows_amd64.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "MZ") {
+		t.Fatal("windows binary isn't a PE file")
+	}
+	if _, err := os.Stat(out + "_darwin_amd64"); !os.IsNotExist(err) {
+		t.Fatalf("failed target was written (stat err=%v)", err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.shareGOCACHE()
+
+	license := filepath.Join(tg.tmp, "LICENSE")
+	if err := ioutil.WriteFile(license, []byte("do what you like\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dist := filepath.Join(tg.tmp, "dist")
+	rc := releaseConfig{
+		grbConfig: grbConfig{
+			serverURL: tg.server.URL,
+			pkgs:      []string{"./multi/..."},
+			gopath:    tg.gopath,
+			dir:       "testdata/src",
+			targets:   "linux/amd64,windows/amd64",
+		},
+		outDir: dist,
+		files:  []string{license},
+	}
+	if err := runRelease(rc); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dist, "multi_linux_amd64.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if got, want := strings.Join(names, " "), "multi_linux_amd64/bar multi_linux_amd64/foo multi_linux_amd64/LICENSE"; got != want {
+		t.Errorf("tar file has %q; want %q", got, want)
+	}
+
+	zr, err := zip.OpenReader(filepath.Join(dist, "multi_windows_amd64.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	names = nil
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if got, want := strings.Join(names, " "), "multi_windows_amd64/bar.exe multi_windows_amd64/foo.exe multi_windows_amd64/LICENSE"; got != want {
+		t.Errorf("zip file has %q; want %q", got, want)
+	}
+
+	sums, err := ioutil.ReadFile(filepath.Join(dist, "SHA256SUMS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(sums)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got SHA256SUMS:\n%s\nwant 2 lines", sums)
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		b, err := ioutil.ReadFile(filepath.Join(dist, fields[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != fields[0] {
+			t.Errorf("SHA256SUMS has wrong hash for %s", fields[1])
+		}
+	}
+}
+
+func TestDeb(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Debian packages are only made for linux")
+	}
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+
+	deb := filepath.Join(tg.tmp, "hello.deb")
+	c := grbConfig{
+		serverURL: tg.server.URL,
+		out:       filepath.Join(tg.tmp, "hello"),
+		pkg:       "hello",
+		gopath:    tg.gopath,
+		deb: debConfig{
+			out:        deb,
+			name:       "hello-world",
+			version:    "1.0-1",
+			maintainer: "Gopher <gopher@example.com>",
+			dir:        "/opt/hello/bin",
+		},
+	}
+	if err := runGRB(c); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(deb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "!<arch>\ndebian-binary") {
+		t.Fatal("output isn't a Debian package")
+	}
+	if _, err := exec.LookPath("dpkg-deb"); err != nil {
+		return
+	}
+	out, err := exec.Command("dpkg-deb", "--field", deb, "Package", "Version").Output()
+	if err != nil {
+		t.Fatalf("dpkg-deb --field: %s", err)
+	}
+	if got, want := string(out), "Package: hello-world\nVersion: 1.0-1\n"; got != want {
+		t.Errorf("got fields %q; want %q", got, want)
+	}
+	out, err = exec.Command("dpkg-deb", "--contents", deb).Output()
+	if err != nil {
+		t.Fatalf("dpkg-deb --contents: %s", err)
+	}
+	if !strings.Contains(string(out), " ./opt/hello/bin/hello\n") {
+		t.Errorf("package doesn't contain the binary:\n%s", out)
+	}
+}
+
+func TestImage(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+
+	image := filepath.Join(tg.tmp, "hello.tar")
+	c := grbConfig{
+		serverURL: tg.server.URL,
+		out:       filepath.Join(tg.tmp, "hello"),
+		pkg:       "hello",
+		gopath:    tg.gopath,
+		image: imageConfig{
+			out:    image,
+			labels: "org.opencontainers.image.version=1.0",
+		},
+	}
+	if err := runGRB(c); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files := make(map[string][]byte)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = b
+	}
+	if _, ok := files["oci-layout"]; !ok {
+		t.Fatal("image has no oci-layout file")
+	}
+	var index struct {
+		Manifests []struct {
+			Annotations map[string]string
+		}
+	}
+	if err := json.Unmarshal(files["index.json"], &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("got %d manifests; want 1", len(index.Manifests))
+	}
+	if got, want := index.Manifests[0].Annotations["org.opencontainers.image.ref.name"], "hello:latest"; got != want {
+		t.Errorf("got image ref %q; want %q", got, want)
+	}
+}
+
+func TestTest(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("tests are only run in a sandbox on Linux")
+	}
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.shareGOCACHE()
+	tg.grbServer.TestTimeout = time.Minute
+	// The tests don't see the server's environment.
+	os.Setenv("GRB_TEST_SECRET", "secret")
+	defer os.Unsetenv("GRB_TEST_SECRET")
+
+	for _, tt := range []struct {
+		testFlags []string
+		status    int
+		want      []string
+	}{
+		{[]string{"-run", "Greeting|Lib", "-v"}, 0, []string{"--- PASS: TestGreeting", "--- PASS: TestLib"}},
+		{[]string{"-run=Failure"}, 1, []string{"failed on purpose", "FAIL"}},
+		{[]string{"-run=Sandbox", "-v"}, 0, []string{"--- PASS: TestSandbox"}},
+	} {
+		var out bytes.Buffer
+		c := grbConfig{
+			serverURL: tg.server.URL,
+			pkgs:      []string{"tested"},
+			gopath:    tg.gopath,
+			stdout:    &out,
+			test:      true,
+			testFlags: tt.testFlags,
+		}
+		err := runGRB(c)
+		if tt.status == 0 && err != nil {
+			t.Fatalf("%q: %s", tt.testFlags, err)
+		}
+		if tt.status != 0 {
+			if e, ok := err.(*exitStatusError); !ok || e.status != tt.status {
+				t.Fatalf("%q: got err=%v; want exit status %d", tt.testFlags, err, tt.status)
+			}
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%q: output doesn't contain %q:\n%s", tt.testFlags, want, out.String())
+			}
+		}
+	}
+
+	// go test is killed after the time limit.
+	tg.grbServer.TestTimeout = 5 * time.Second
+	var out bytes.Buffer
+	c := grbConfig{
+		serverURL: tg.server.URL,
+		pkgs:      []string{"tested"},
+		gopath:    tg.gopath,
+		stdout:    &out,
+		test:      true,
+		testFlags: []string{"-run=Sleep"},
+	}
+	if err := runGRB(c); err == nil || !strings.Contains(out.String(), "killed after the time limit of 5s") {
+		t.Fatalf("running TestSleep: got err=%v and output:\n%s", err, out.String())
+	}
+
+	// TestSandbox overwrote its copy of tested.go, not the cached file.
+	src := filepath.Join(tg.gopath, "src", "tested", "tested.go")
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(b)
+	cached, err := ioutil.ReadFile(grb.FileStore(filepath.Join(tg.dataDir, "cache")).Path(hex.EncodeToString(sum[:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, b) {
+		t.Errorf("cached copy of tested.go was modified: %q", cached)
+	}
+
+	// Flags that could write files on the server aren't allowed.
+	c.stdout = nil
+	c.testFlags = []string{"-outputdir", "/tmp"}
+	if err := runGRB(c); err != errStatusNot200 {
+		t.Fatalf("with disallowed flag: got err=%v; want %v", err, errStatusNot200)
+	}
+
+	// The server doesn't run tests unless it has a time limit.
+	tg.grbServer.TestTimeout = 0
+	c.testFlags = nil
+	if err := runGRB(c); err != errStatusNot200 {
+		t.Fatalf("without -testtimeout: got err=%v; want %v", err, errStatusNot200)
+	}
+}
+
+func TestRun(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binaries are only run in a sandbox on Linux")
+	}
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.shareGOCACHE()
+	tg.grbServer.RunTimeout = 2 * time.Second
+
+	for _, tt := range []struct {
+		args   []string
+		status int
+		want   string
+	}{
+		{[]string{"a", "b"}, 0, "args: a b\n"},
+		{[]string{"exit", "3"}, 3, ""},
+		{[]string{"sleep"}, 128 + 9, ""}, // killed by SIGKILL
+	} {
+		var out bytes.Buffer
+		c := grbConfig{
+			serverURL: tg.server.URL,
+			pkg:       "runner",
+			gopath:    tg.gopath,
+			stdout:    &out,
+			run:       true,
+			runArgs:   tt.args,
+		}
+		err := runGRB(c)
+		if tt.status == 0 && err != nil {
+			t.Fatalf("%q: %s", tt.args, err)
+		}
+		if tt.status != 0 {
+			if e, ok := err.(*exitStatusError); !ok || e.status != tt.status {
+				t.Fatalf("%q: got err=%v; want exit status %d", tt.args, err, tt.status)
+			}
+		}
+		if got := out.String(); got != tt.want {
+			t.Errorf("%q: got output %q; want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// The sandbox has no network and only sees the system directories and
+	// its own directory.
+	cached, err := filepath.Abs(filepath.Join(tg.dataDir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := filepath.Abs(filepath.Join("testdata", "src", "runner", "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"dial", strings.TrimPrefix(tg.server.URL, "http://")}, "dial failed\n"},
+		{[]string{"read", "/etc/passwd"}, "read succeeded\n"},
+		{[]string{"read", source}, "read failed\n"},
+		{[]string{"write", filepath.Join(cached, "x")}, "write failed\n"},
+		{[]string{"write", "/usr/x"}, "write failed\n"},
+		{[]string{"write", "/x"}, "write failed\n"},
+		{[]string{"write", "x"}, "write succeeded\n"},
+	} {
+		var out bytes.Buffer
+		c := grbConfig{
+			serverURL: tg.server.URL,
+			pkg:       "runner",
+			gopath:    tg.gopath,
+			stdout:    &out,
+			run:       true,
+			runArgs:   tt.args,
+		}
+		if err := runGRB(c); err != nil {
+			t.Fatalf("%q: %s", tt.args, err)
+		}
+		if got := out.String(); got != tt.want {
+			t.Errorf("%q: got %q; want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// The server doesn't run binaries unless it has a time limit.
+	tg.grbServer.RunTimeout = 0
+	c := grbConfig{
+		serverURL: tg.server.URL,
+		pkg:       "runner",
+		gopath:    tg.gopath,
+		stdout:    ioutil.Discard,
+		run:       true,
+	}
+	if err := runGRB(c); err != errStatusNot200 {
+		t.Fatalf("without -runtimeout: got err=%v; want %v", err, errStatusNot200)
+	}
+}
+
+func TestSplitRunArgs(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		pkg     string
+		runArgs []string
+	}{
+		{nil, ".", nil},
+		{[]string{"runner"}, "runner", nil},
+		{[]string{"runner", "a", "b"}, "runner", []string{"a", "b"}},
+		{[]string{"-race", "runner", "--", "-v"}, "runner", []string{"-v"}},
+		{[]string{"--", "-v"}, ".", []string{"-v"}},
+		{[]string{"-race", "--", "a"}, ".", []string{"a"}},
+	} {
+		fs := flag.NewFlagSet("run", flag.ContinueOnError)
+		fs.Bool("race", false, "")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		pkg, runArgs := splitRunArgs(tt.args, fs.Args())
+		if pkg != tt.pkg || strings.Join(runArgs, " ") != strings.Join(tt.runArgs, " ") {
+			t.Errorf("splitRunArgs(%q): got %q, %q; want %q, %q", tt.args, pkg, runArgs, tt.pkg, tt.runArgs)
+		}
+	}
+}
+
+func TestVet(t *testing.T) {
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.shareGOCACHE()
+
+	var out bytes.Buffer
+	c := grbConfig{
+		serverURL: tg.server.URL,
+		pkgs:      []string{"tested"},
+		gopath:    tg.gopath,
+		stdout:    &out,
+		vet:       true,
+	}
+	if err := runGRB(c); err != nil {
+		t.Fatalf("vetting clean package: %s\n%s", err, out.String())
+	}
+
+	c.pkgs = []string{"vetme"}
+	c.vetJSON = true
+	if err := runGRB(c); err != errVetFailed {
+		t.Fatalf("got err=%v; want %v", err, errVetFailed)
+	}
+	var result grb.VetResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Diagnostics) != 1 {
+		t.Fatalf("got %d diagnostics; want 1", len(result.Diagnostics))
+	}
+	d := result.Diagnostics[0]
+	want := filepath.Join(tg.gopath, "src", "vetme", "vetme.go")
+	if d.LocalPath != want || d.Line != 6 || d.Analyzer != "printf" {
+		t.Errorf("got diagnostic %+v; want printf diagnostic at %s:6", d, want)
+	}
+}
+
+func TestTestOutputs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("tests are only run in a sandbox on Linux")
+	}
+	tg := newTestGRB(t)
+	defer tg.cleanup()
+	tg.shareGOCACHE()
+	tg.grbServer.TestTimeout = time.Minute
+
+	cover := filepath.Join(tg.tmp, "cover.out")
+	cpu := filepath.Join(tg.tmp, "cpu.out")
+	c := grbConfig{
+		serverURL: tg.server.URL,
+		out:       tg.tmp,
+		pkgs:      []string{"tested"},
+		gopath:    tg.gopath,
+		stdout:    ioutil.Discard,
+		test:      true,
+		testFlags: []string{"-run", "Greeting", "-coverprofile=" + cover, "-cpuprofile", cpu},
+	}
+	if err := runGRB(c); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(cover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The profile refers to the local files.
+	local := filepath.Join(tg.gopath, "src", "tested", "tested.go") + ":"
+	if !strings.HasPrefix(string(b), "mode: ") || !strings.Contains(string(b), "\n"+local) {
+		t.Errorf("coverage profile doesn't refer to %s:\n%s", local, b)
+	}
+	if fi, err := os.Stat(cpu); err != nil || fi.Size() == 0 {
+		t.Errorf("no CPU profile (stat err=%v)", err)
+	}
+	// With -cpuprofile, go test keeps the test binary.
+	bin := filepath.Join(tg.tmp, "tested.test")
+	out, err := exec.Command(bin, "-test.run", "Lib").CombinedOutput()
+	if err != nil {
+		t.Fatalf("running test binary: %s\n%s", err, out)
+	}
+}
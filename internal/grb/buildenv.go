@@ -0,0 +1,74 @@
+package grb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// buildEnvVars lists the environment variables that a server's BuildEnv
+// policy may allow clients to set for builds.
+var buildEnvVars = map[string]bool{
+	"CGO_ENABLED": true,
+	"CGO_CFLAGS":  true,
+	"CGO_LDFLAGS": true,
+	"CC":          true,
+}
+
+// ParseBuildEnv parses a BuildEnv policy written as a comma-separated list
+// of variables, each optionally followed by = and the values allowed for
+// it, separated by |, as in "CGO_ENABLED=0|1,CGO_CFLAGS".
+func ParseBuildEnv(s string) (map[string][]string, error) {
+	policy := make(map[string][]string)
+	if s == "" {
+		return policy, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		name := entry
+		var values []string
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			name = entry[:i]
+			values = strings.Split(entry[i+1:], "|")
+		}
+		if !buildEnvVars[name] {
+			return nil, fmt.Errorf("build environment variable %q is not supported", name)
+		}
+		policy[name] = values
+	}
+	return policy, nil
+}
+
+// checkBuildEnv returns an error if env sets any variable, or value, that
+// the server's BuildEnv doesn't allow.
+func (s *Server) checkBuildEnv(env map[string]string) error {
+	for name, value := range env {
+		allowed, ok := s.BuildEnv[name]
+		if !ok || !buildEnvVars[name] {
+			return fmt.Errorf("build environment variable %s is not allowed", name)
+		}
+		if allowed == nil {
+			continue
+		}
+		ok = false
+		for _, v := range allowed {
+			if value == v {
+				ok = true
+			}
+		}
+		if !ok {
+			return fmt.Errorf("value %q for build environment variable %s is not allowed", value, name)
+		}
+	}
+	return nil
+}
+
+// environ returns the build environment variables of breq in the form
+// used by exec.Cmd.
+func (breq *BuildRequest) environ() []string {
+	var env []string
+	for name, value := range breq.Env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
@@ -0,0 +1,49 @@
+package grb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBuildEnv(t *testing.T) {
+	got, err := ParseBuildEnv("CGO_ENABLED=0|1,CGO_CFLAGS,CC=gcc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"CGO_ENABLED": {"0", "1"},
+		"CGO_CFLAGS":  nil,
+		"CC":          {"gcc"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q; want %q", got, want)
+	}
+	for _, s := range []string{"GOFLAGS", "CGO_ENABLED=0,PATH=/tmp"} {
+		if _, err := ParseBuildEnv(s); err == nil {
+			t.Errorf("ParseBuildEnv(%q): got no error", s)
+		}
+	}
+}
+
+func TestCheckBuildEnv(t *testing.T) {
+	s := &Server{BuildEnv: map[string][]string{
+		"CGO_ENABLED": {"0", "1"},
+		"CGO_CFLAGS":  nil,
+		"PATH":        nil, // never allowed
+	}}
+	for _, tt := range []struct {
+		env map[string]string
+		ok  bool
+	}{
+		{nil, true},
+		{map[string]string{"CGO_ENABLED": "0", "CGO_CFLAGS": "-O2 -g"}, true},
+		{map[string]string{"CGO_ENABLED": "2"}, false},
+		{map[string]string{"CC": "gcc"}, false},
+		{map[string]string{"PATH": "/tmp"}, false},
+	} {
+		err := s.checkBuildEnv(tt.env)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkBuildEnv(%q): got err=%v; want ok=%t", tt.env, err, tt.ok)
+		}
+	}
+}
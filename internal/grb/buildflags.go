@@ -0,0 +1,221 @@
+package grb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A buildFlag describes a go build flag that clients may use.
+type buildFlag struct {
+	// isBool is set for flags that may be given without a value.
+	isBool bool
+	// check checks the value of the flag.
+	check func(value string) error
+}
+
+// buildFlags lists the go build flags that clients may use. Flags that
+// write files on the server, or run other programs, are not allowed, and
+// neither are such flags in the values of -gcflags, -asmflags, and
+// -ldflags.
+var buildFlags = map[string]buildFlag{
+	"a":         {isBool: true, check: checkBool},
+	"asan":      {isBool: true, check: checkBool},
+	"asmflags":  {check: checkToolFlags(asmFlags)},
+	"buildmode": {check: checkOneOf("default", "exe", "pie", "c-archive", "c-shared", "plugin")},
+	"buildvcs":  {isBool: true, check: checkOneOf("true", "false", "auto")},
+	"cover":     {isBool: true, check: checkBool},
+	"gcflags":   {check: checkToolFlags(gcFlags)},
+	"ldflags":   {check: checkToolFlags(ldFlags)},
+	"msan":      {isBool: true, check: checkBool},
+	// A profile is sent as default.pgo in the main package.
+	"pgo":      {check: checkOneOf("auto", "off")},
+	"race":     {isBool: true, check: checkBool},
+	"tags":     {check: checkTags},
+	"trimpath": {isBool: true, check: checkBool},
+}
+
+// The flags of the compiler, assembler, and linker that clients may use,
+// mapped to whether they take a value (as a separate argument, if not
+// given with =).
+var (
+	gcFlags = map[string]bool{
+		"B":           false,
+		"C":           false,
+		"N":           false,
+		"S":           false,
+		"c":           true,
+		"dwarf":       false,
+		"e":           false,
+		"l":           false,
+		"live":        false,
+		"m":           false,
+		"smallframes": false,
+		"spectre":     true,
+		"wb":          false,
+	}
+	asmFlags = map[string]bool{
+		"D":       true,
+		"S":       false,
+		"e":       false,
+		"spectre": true,
+	}
+	ldFlags = map[string]bool{
+		"B":             true,
+		"X":             true,
+		"buildid":       true,
+		"compressdwarf": false,
+		"linkmode":      true,
+		"s":             false,
+		"w":             false,
+	}
+)
+
+// CheckBuildFlags returns an error if flags includes anything but the
+// allowed go build flags and their values.
+func CheckBuildFlags(flags []string) error {
+	for i := 0; i < len(flags); i++ {
+		flag := flags[i]
+		if !strings.HasPrefix(flag, "-") {
+			return fmt.Errorf("unexpected argument %q in build flags", flag)
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(flag, "-"), "-")
+		value, hasValue := "", false
+		if j := strings.IndexByte(name, '='); j >= 0 {
+			name, value = name[:j], name[j+1:]
+			hasValue = true
+		}
+		f, ok := buildFlags[name]
+		if !ok {
+			return fmt.Errorf("build flag %s is not allowed", flag)
+		}
+		if !hasValue {
+			if f.isBool {
+				continue
+			}
+			i++
+			if i == len(flags) {
+				return fmt.Errorf("build flag %s needs a value", flag)
+			}
+			value = flags[i]
+		}
+		if err := f.check(value); err != nil {
+			return fmt.Errorf("bad value for -%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// boolFlagSet reports whether the boolean build flag name is set in flags,
+// which have been checked with CheckBuildFlags.
+func boolFlagSet(flags []string, name string) bool {
+	set := false
+	for i := 0; i < len(flags); i++ {
+		flag := strings.TrimPrefix(strings.TrimPrefix(flags[i], "-"), "-")
+		value := "true"
+		if j := strings.IndexByte(flag, '='); j >= 0 {
+			flag, value = flag[:j], flag[j+1:]
+		} else if !buildFlags[flag].isBool {
+			i++ // skip the value
+		}
+		if flag == name {
+			set, _ = strconv.ParseBool(value)
+		}
+	}
+	return set
+}
+
+func checkBool(value string) error {
+	_, err := strconv.ParseBool(value)
+	return err
+}
+
+func checkOneOf(values ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(values, ", "))
+	}
+}
+
+func checkTags(value string) error {
+	if strings.Trim(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_., ") != "" {
+		return fmt.Errorf("malformed build tags %q", value)
+	}
+	return nil
+}
+
+// checkToolFlags returns a function that checks the value of a flag, such
+// as -gcflags, that passes flags to a tool. As with go build, the value
+// may start with a package pattern and =, and it may quote arguments.
+// allowed lists the tool's flags that may be used.
+func checkToolFlags(allowed map[string]bool) func(string) error {
+	return func(value string) error {
+		if !strings.HasPrefix(value, "-") {
+			if i := strings.IndexByte(value, '='); i >= 0 {
+				value = value[i+1:]
+			}
+		}
+		args, err := splitQuoted(value)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(args); i++ {
+			arg := args[i]
+			if !strings.HasPrefix(arg, "-") {
+				return fmt.Errorf("unexpected argument %q", arg)
+			}
+			name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+			hasValue := false
+			if j := strings.IndexByte(name, '='); j >= 0 {
+				name = name[:j]
+				hasValue = true
+			}
+			takesValue, ok := allowed[name]
+			if !ok {
+				return fmt.Errorf("flag %s is not allowed", arg)
+			}
+			if takesValue && !hasValue {
+				i++
+				if i == len(args) {
+					return fmt.Errorf("flag %s needs a value", arg)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// splitQuoted splits s into fields separated by white space, as go build
+// does for the values of flags such as -ldflags. A field may be quoted with
+// single or double quotes.
+func splitQuoted(s string) ([]string, error) {
+	var fields []string
+	for {
+		s = strings.TrimLeft(s, " \t\n\r")
+		if s == "" {
+			return fields, nil
+		}
+		if q := s[0]; q == '\'' || q == '"' {
+			i := strings.IndexByte(s[1:], q)
+			if i < 0 {
+				return nil, fmt.Errorf("unterminated %c string", q)
+			}
+			fields = append(fields, s[1:i+1])
+			s = s[i+2:]
+			if s != "" && !strings.ContainsAny(s[:1], " \t\n\r") {
+				return nil, fmt.Errorf("quoted string must be followed by white space")
+			}
+			continue
+		}
+		i := strings.IndexAny(s, " \t\n\r")
+		if i < 0 {
+			i = len(s)
+		}
+		fields = append(fields, s[:i])
+		s = s[i:]
+	}
+}
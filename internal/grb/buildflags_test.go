@@ -0,0 +1,83 @@
+package grb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckBuildFlags(t *testing.T) {
+	for _, tt := range []struct {
+		flags []string
+		ok    bool
+	}{
+		{nil, true},
+		{[]string{"-race", "-ldflags", "-s -w", "-trimpath"}, true},
+		{[]string{"--a", "-cover=true", "-buildvcs", "-buildvcs=false"}, true},
+		{[]string{"-gcflags=all=-N -l", "-asmflags", "-S"}, true},
+		{[]string{"-ldflags", `-X "main.v=a b" -X=main.w=c`, "-tags", "a,b"}, true},
+		{[]string{"-gcflags", "-m=2 -spectre all", "-buildmode=pie", "-pgo=off"}, true},
+		{[]string{"-ldflags"}, false},
+		{[]string{"-o", "/tmp/x"}, false},
+		{[]string{"-toolexec", "sh"}, false},
+		{[]string{"-race", "extra"}, false},
+		{[]string{"-race=maybe"}, false},
+		{[]string{"-buildvcs=sometimes"}, false},
+		{[]string{"-buildmode", "shared"}, false},
+		{[]string{"-pgo", "/tmp/cpu.pprof"}, false},
+		{[]string{"-tags", "a;b"}, false},
+		{[]string{"-gcflags", "-cpuprofile=/tmp/x"}, false},
+		{[]string{"-gcflags", "all=-N extra"}, false},
+		{[]string{"-ldflags", "-extld=sh"}, false},
+		{[]string{"-ldflags", "-X"}, false},
+		{[]string{"-ldflags", `-X "main.v=a`}, false},
+	} {
+		err := CheckBuildFlags(tt.flags)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckBuildFlags(%q): got err=%v; want ok=%t", tt.flags, err, tt.ok)
+		}
+	}
+}
+
+func TestBoolFlagSet(t *testing.T) {
+	for _, tt := range []struct {
+		flags []string
+		want  bool
+	}{
+		{nil, false},
+		{[]string{"-trimpath"}, true},
+		{[]string{"--trimpath=true"}, true},
+		{[]string{"-trimpath", "-trimpath=false"}, false},
+		{[]string{"-ldflags", "-trimpath"}, false},
+		{[]string{"-tags", "a", "-race", "-trimpath"}, true},
+	} {
+		if got := boolFlagSet(tt.flags, "trimpath"); got != tt.want {
+			t.Errorf("boolFlagSet(%q, trimpath) = %t; want %t", tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestSplitQuoted(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want []string
+	}{
+		{"", nil},
+		{" -s  -w ", []string{"-s", "-w"}},
+		{`-X 'main.v=a b' -X "main.w=c"`, []string{"-X", "main.v=a b", "-X", "main.w=c"}},
+		{`-X ""`, []string{"-X", ""}},
+	} {
+		got, err := splitQuoted(tt.s)
+		if err != nil {
+			t.Errorf("splitQuoted(%q): %s", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitQuoted(%q) = %q; want %q", tt.s, got, tt.want)
+		}
+	}
+	for _, s := range []string{`'a`, `"a"b`} {
+		if _, err := splitQuoted(s); err == nil {
+			t.Errorf("splitQuoted(%q): got no error", s)
+		}
+	}
+}
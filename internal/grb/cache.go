@@ -12,13 +12,50 @@ import (
 
 var errHashMismatch = errors.New("SHA256 hash of uploaded file doesn't match declared hash")
 
-type Cache string
+// A Store is a content-addressed blob store. Blobs are keyed by the hex
+// SHA-256 hash of their contents.
+type Store interface {
+	// Put stores the contents of r under hash. It returns an error, and
+	// stores nothing, if the contents don't match hash.
+	Put(hash string, r io.Reader) error
+	// Has reports whether the blob for hash is in the store.
+	Has(hash string) (bool, error)
+	// Open opens the blob for hash for reading. If the blob isn't present,
+	// the error satisfies os.IsNotExist.
+	Open(hash string) (io.ReadCloser, error)
+	// Delete removes the blob for hash. It is not an error to delete a blob
+	// which isn't present.
+	Delete(hash string) error
+	// Walk calls fn with the hash of every blob in the store, stopping at
+	// the first error.
+	Walk(fn func(hash string) error) error
+}
+
+// A LocalStore is a Store that can make its blobs available as local files.
+type LocalStore interface {
+	Store
+	// LocalPath returns the path of a local file holding the contents of
+	// the blob for hash.
+	LocalPath(hash string) (string, error)
+}
+
+// FileStore is a LocalStore which keeps blobs in a directory on the local
+// filesystem.
+type FileStore string
 
-func (c Cache) Path(hash string) string {
+func (c FileStore) Path(hash string) string {
 	return filepath.Join(string(c), hash[:2], hash[2:])
 }
 
-func (c Cache) Put(hash string, r io.Reader) error {
+func (c FileStore) LocalPath(hash string) (string, error) {
+	path := c.Path(hash)
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (c FileStore) Put(hash string, r io.Reader) error {
 	f, err := ioutil.TempFile(string(c), "grbcache")
 	if err != nil {
 		return err
@@ -50,16 +87,133 @@ func (c Cache) Put(hash string, r io.Reader) error {
 	return os.Rename(f.Name(), dest)
 }
 
-func (c Cache) FindMissing(packages []*Package) ([]*Package, error) {
+func (c FileStore) Has(hash string) (bool, error) {
+	_, err := os.Stat(c.Path(hash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (c FileStore) Open(hash string) (io.ReadCloser, error) {
+	return os.Open(c.Path(hash))
+}
+
+func (c FileStore) Delete(hash string) error {
+	err := os.Remove(c.Path(hash))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (c FileStore) Walk(fn func(hash string) error) error {
+	dirs, err := ioutil.ReadDir(string(c))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		// Skip temp files from in-progress Puts.
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(string(c), dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			hash := dir.Name() + file.Name()
+			if len(hash) != hashSize {
+				continue
+			}
+			if err := fn(hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CachedStore is a LocalStore which keeps local copies of the blobs in a
+// (typically remote) Store. Writes go to both stores; reads are served
+// locally when possible.
+type CachedStore struct {
+	Remote Store
+	Local  FileStore
+}
+
+func (c *CachedStore) Put(hash string, r io.Reader) error {
+	if err := c.Local.Put(hash, r); err != nil {
+		return err
+	}
+	f, err := c.Local.Open(hash)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.Remote.Put(hash, f)
+}
+
+func (c *CachedStore) Has(hash string) (bool, error) {
+	ok, err := c.Local.Has(hash)
+	if err != nil || ok {
+		return ok, err
+	}
+	return c.Remote.Has(hash)
+}
+
+func (c *CachedStore) Open(hash string) (io.ReadCloser, error) {
+	path, err := c.LocalPath(hash)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// LocalPath fetches the blob for hash from the remote store if there's no
+// local copy.
+func (c *CachedStore) LocalPath(hash string) (string, error) {
+	path, err := c.Local.LocalPath(hash)
+	if err == nil || !os.IsNotExist(err) {
+		return path, err
+	}
+	rc, err := c.Remote.Open(hash)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if err := c.Local.Put(hash, rc); err != nil {
+		return "", err
+	}
+	return c.Local.Path(hash), nil
+}
+
+func (c *CachedStore) Delete(hash string) error {
+	if err := c.Local.Delete(hash); err != nil {
+		return err
+	}
+	return c.Remote.Delete(hash)
+}
+
+func (c *CachedStore) Walk(fn func(hash string) error) error {
+	return c.Remote.Walk(fn)
+}
+
+// FindMissing returns the subset of the files in packages which are not
+// present in s.
+func FindMissing(s Store, packages []*Package) ([]*Package, error) {
 	var missing []*Package
 	for _, pkg := range packages {
 		var files []File
 		for _, file := range pkg.Files {
-			_, err := os.Stat(c.Path(file.Hash))
+			ok, err := s.Has(file.Hash)
 			if err != nil {
-				if !os.IsNotExist(err) {
-					return nil, err
-				}
+				return nil, err
+			}
+			if !ok {
 				files = append(files, file)
 			}
 		}
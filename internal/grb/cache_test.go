@@ -0,0 +1,252 @@
+package grb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grb-filestore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testStore(t, FileStore(dir))
+}
+
+func TestS3Store(t *testing.T) {
+	fake := newFakeS3("bucket")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	testStore(t, &S3Store{
+		Endpoint:  server.URL,
+		Region:    "us-east-1",
+		Bucket:    "bucket",
+		Prefix:    "blobs/",
+		AccessKey: "key",
+		SecretKey: "secret",
+	})
+}
+
+func TestCachedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grb-cachedstore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fake := newFakeS3("bucket")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	remote := &S3Store{
+		Endpoint: server.URL,
+		Region:   "us-east-1",
+		Bucket:   "bucket",
+	}
+	testStore(t, &CachedStore{Remote: remote, Local: FileStore(dir)})
+
+	// A blob put by another server is fetched on demand.
+	data := []byte("from elsewhere")
+	hash := hashBytes(data)
+	if err := remote.Put(hash, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	cs := &CachedStore{Remote: remote, Local: FileStore(dir)}
+	path, err := cs.LocalPath(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("LocalPath contents: got %q; want %q", got, data)
+	}
+}
+
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+	var hashes []string
+	for _, data := range []string{"a", "b", "c", "d", "e"} {
+		hash := hashBytes([]byte(data))
+		if err := s.Put(hash, strings.NewReader(data)); err != nil {
+			t.Fatalf("Put(%q): %s", data, err)
+		}
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	badHash := hashBytes([]byte("x"))
+	if err := s.Put(badHash, strings.NewReader("y")); err != errHashMismatch {
+		t.Fatalf("Put with bad hash: got err=%v; want %v", err, errHashMismatch)
+	}
+	if ok, err := s.Has(badHash); err != nil || ok {
+		t.Fatalf("Has(badHash): got (%t, %v); want (false, nil)", ok, err)
+	}
+
+	if ok, err := s.Has(hashes[0]); err != nil || !ok {
+		t.Fatalf("Has: got (%t, %v); want (true, nil)", ok, err)
+	}
+	rc, err := s.Open(hashBytes([]byte("c")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "c" {
+		t.Fatalf("Open: got contents %q; want %q", b, "c")
+	}
+	if _, err := s.Open(badHash); !os.IsNotExist(err) {
+		t.Fatalf("Open of missing blob: got err=%v; want not-exist error", err)
+	}
+
+	var walked []string
+	if err := s.Walk(func(hash string) error {
+		walked = append(walked, hash)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(walked)
+	if strings.Join(walked, ",") != strings.Join(hashes, ",") {
+		t.Fatalf("Walk: got %q; want %q", walked, hashes)
+	}
+
+	for _, hash := range hashes[:2] {
+		if err := s.Delete(hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(badHash); err != nil {
+		t.Fatalf("Delete of missing blob: %s", err)
+	}
+	if ok, err := s.Has(hashes[0]); err != nil || ok {
+		t.Fatalf("Has after Delete: got (%t, %v); want (false, nil)", ok, err)
+	}
+
+	missing, err := FindMissing(s, []*Package{
+		{Name: "p", Files: []File{
+			{Name: "a.go", Hash: hashes[0]},
+			{Name: "b.go", Hash: hashes[2]},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || len(missing[0].Files) != 1 || missing[0].Files[0].Name != "a.go" {
+		t.Fatalf("FindMissing: got %+v; want just a.go", missing)
+	}
+}
+
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// fakeS3 is a minimal in-memory stand-in for an S3 bucket.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: make(map[string][]byte)}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+		http.Error(w, "missing signature", http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/"+f.bucket && r.Method == "GET" {
+		f.list(w, r)
+		return
+	}
+	key, ok := trimPrefix(r.URL.Path, "/"+f.bucket+"/")
+	if !ok {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if hashBytes(b) != r.Header.Get("X-Amz-Content-Sha256") {
+			http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = b
+	case "GET", "HEAD":
+		b, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Write(b)
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+// list implements ListObjectsV2 with a small page size to exercise
+// pagination.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	const pageSize = 2
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start := 0
+	if token := r.URL.Query().Get("continuation-token"); token != "" {
+		start = sort.SearchStrings(keys, token)
+	}
+	type object struct {
+		Key string
+	}
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	for i := start; i < len(keys); i++ {
+		if len(result.Contents) == pageSize {
+			result.IsTruncated = true
+			result.NextContinuationToken = keys[i]
+			break
+		}
+		result.Contents = append(result.Contents, object{keys[i]})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(&result)
+}
@@ -0,0 +1,241 @@
+package grb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A DebPackage describes a Debian binary package holding a single
+// executable and, optionally, a systemd unit for it.
+type DebPackage struct {
+	Name        string
+	Binary      string // file name of the executable in InstallDir
+	Version     string
+	Arch        string // a Debian architecture; see DebArch
+	Maintainer  string
+	Description string
+	Depends     []string
+	InstallDir  string // such as /usr/bin
+	Unit        []byte // if set, installed as /lib/systemd/system/<Name>.service
+	Time        time.Time
+}
+
+var (
+	debNameRE    = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+	debVersionRE = regexp.MustCompile(`^([0-9]+:)?[0-9][A-Za-z0-9.+~:-]*$`)
+)
+
+// debArches maps GOARCH values to Debian architectures.
+var debArches = map[string]string{
+	"386":      "i386",
+	"amd64":    "amd64",
+	"arm":      "armhf",
+	"arm64":    "arm64",
+	"mips":     "mips",
+	"mipsle":   "mipsel",
+	"mips64le": "mips64el",
+	"ppc64le":  "ppc64el",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+// DebArch returns the Debian architecture for goarch.
+func DebArch(goarch string) (string, error) {
+	arch, ok := debArches[goarch]
+	if !ok {
+		return "", fmt.Errorf("no Debian architecture for GOARCH=%s", goarch)
+	}
+	return arch, nil
+}
+
+func (p *DebPackage) validate() error {
+	if !debNameRE.MatchString(p.Name) {
+		return fmt.Errorf("invalid Debian package name %q", p.Name)
+	}
+	if p.Binary == "" || p.Binary == "." || p.Binary == ".." || strings.Contains(p.Binary, "/") {
+		return fmt.Errorf("invalid binary name %q", p.Binary)
+	}
+	if !debVersionRE.MatchString(p.Version) {
+		return fmt.Errorf("invalid Debian package version %q", p.Version)
+	}
+	if p.Arch == "" || p.Maintainer == "" || !path.IsAbs(p.InstallDir) {
+		return fmt.Errorf("Debian package needs an architecture, maintainer, and absolute install directory")
+	}
+	for _, field := range append([]string{p.Maintainer, p.Description}, p.Depends...) {
+		if strings.ContainsAny(field, "\r\n") {
+			return fmt.Errorf("Debian control field %q contains a newline", field)
+		}
+	}
+	return nil
+}
+
+// Write writes p, containing the executable bin, to w as a .deb file.
+func (p *DebPackage) Write(w io.Writer, bin []byte) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	mtime := p.Time
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	mtime = mtime.Truncate(time.Second)
+
+	var files []debFile
+	files = append(files, debFile{path.Join(p.InstallDir, p.Binary), bin, 0755})
+	if p.Unit != nil {
+		files = append(files, debFile{"/lib/systemd/system/" + p.Name + ".service", p.Unit, 0644})
+	}
+	data, err := debTarGz(files, mtime, true)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	var md5sums bytes.Buffer
+	for _, f := range files {
+		size += int64(len(f.data))
+		sum := md5.Sum(f.data)
+		fmt.Fprintf(&md5sums, "%s  %s\n", hex.EncodeToString(sum[:]), strings.TrimPrefix(f.name, "/"))
+	}
+	var control bytes.Buffer
+	fmt.Fprintf(&control, "Package: %s\n", p.Name)
+	fmt.Fprintf(&control, "Version: %s\n", p.Version)
+	fmt.Fprintf(&control, "Architecture: %s\n", p.Arch)
+	fmt.Fprintf(&control, "Maintainer: %s\n", p.Maintainer)
+	fmt.Fprintf(&control, "Installed-Size: %d\n", (size+1023)/1024)
+	if len(p.Depends) > 0 {
+		fmt.Fprintf(&control, "Depends: %s\n", strings.Join(p.Depends, ", "))
+	}
+	fmt.Fprintf(&control, "Section: misc\n")
+	fmt.Fprintf(&control, "Priority: optional\n")
+	description := p.Description
+	if description == "" {
+		description = p.Name
+	}
+	fmt.Fprintf(&control, "Description: %s\n", description)
+	controlFiles := []debFile{
+		{"control", control.Bytes(), 0644},
+		{"md5sums", md5sums.Bytes(), 0644},
+	}
+	if p.Unit != nil {
+		// Make systemd notice the new or changed unit.
+		postinst := "#!/bin/sh\nset -e\nif [ -d /run/systemd/system ]; then\n\tsystemctl daemon-reload >/dev/null || true\nfi\n"
+		controlFiles = append(controlFiles, debFile{"postinst", []byte(postinst), 0755})
+	}
+	ctrl, err := debTarGz(controlFiles, mtime, false)
+	if err != nil {
+		return err
+	}
+
+	aw := &arWriter{w: w, mtime: mtime}
+	aw.writeMagic()
+	aw.writeFile("debian-binary", []byte("2.0\n"))
+	aw.writeFile("control.tar.gz", ctrl)
+	aw.writeFile("data.tar.gz", data)
+	return aw.err
+}
+
+type debFile struct {
+	name string
+	data []byte
+	mode int64
+}
+
+// debTarGz writes files to a gzipped tar file in the form used within .deb
+// files, with ./-relative names. If dirs is set, it includes entries for
+// the parent directories.
+func debTarGz(files []debFile, mtime time.Time, dirs bool) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	hdr := func(name string, typ byte, mode, size int64) *tar.Header {
+		return &tar.Header{
+			Name:     "./" + strings.TrimPrefix(name, "/"),
+			Typeflag: typ,
+			Mode:     mode,
+			Size:     size,
+			ModTime:  mtime,
+			Uname:    "root",
+			Gname:    "root",
+		}
+	}
+	if dirs {
+		written := make(map[string]bool)
+		var writeDir func(dir string) error
+		writeDir = func(dir string) error {
+			if written[dir] {
+				return nil
+			}
+			if dir != "/" {
+				if err := writeDir(path.Dir(dir)); err != nil {
+					return err
+				}
+			}
+			written[dir] = true
+			name := strings.TrimSuffix(dir, "/") + "/"
+			return tw.WriteHeader(hdr(name, tar.TypeDir, 0755, 0))
+		}
+		for _, f := range files {
+			if err := writeDir(path.Dir(f.name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, f := range files {
+		if err := tw.WriteHeader(hdr(f.name, tar.TypeReg, f.mode, int64(len(f.data)))); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// arWriter writes the common ar archive format, as used by .deb files.
+// After an error, it does nothing and the error is in err.
+type arWriter struct {
+	w     io.Writer
+	mtime time.Time
+	err   error
+}
+
+func (aw *arWriter) writeMagic() {
+	if aw.err == nil {
+		_, aw.err = io.WriteString(aw.w, "!<arch>\n")
+	}
+}
+
+func (aw *arWriter) writeFile(name string, data []byte) {
+	if aw.err != nil {
+		return
+	}
+	// The header is 60 bytes of space-padded fields.
+	hdr := fmt.Sprintf("%-16s%-12d%-6d%-6d%-8o%-10d`\n",
+		name, aw.mtime.Unix(), 0, 0, 0100644, len(data))
+	if _, aw.err = io.WriteString(aw.w, hdr); aw.err != nil {
+		return
+	}
+	if _, aw.err = aw.w.Write(data); aw.err != nil {
+		return
+	}
+	// Members are aligned to even offsets.
+	if len(data)%2 == 1 {
+		_, aw.err = io.WriteString(aw.w, "\n")
+	}
+}
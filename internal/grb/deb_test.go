@@ -0,0 +1,147 @@
+package grb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebPackage(t *testing.T) {
+	p := &DebPackage{
+		Name:        "hello-server",
+		Binary:      "hello",
+		Version:     "1.2.3-1",
+		Arch:        "amd64",
+		Maintainer:  "Gopher <gopher@example.com>",
+		Description: "says hello",
+		Depends:     []string{"libc6", "ca-certificates"},
+		InstallDir:  "/usr/local/bin",
+		Unit:        []byte("[Service]\nExecStart=/usr/local/bin/hello\n"),
+		Time:        time.Unix(1500000000, 0),
+	}
+	bin := []byte("\x7fELF not really")
+	var buf bytes.Buffer
+	if err := p.Write(&buf, bin); err != nil {
+		t.Fatal(err)
+	}
+	names, data, err := readArMembers(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(names, " "), "debian-binary control.tar.gz data.tar.gz"; got != want {
+		t.Fatalf("got members %q; want %q", got, want)
+	}
+	if string(data[0]) != "2.0\n" {
+		t.Fatalf("got debian-binary %q", data[0])
+	}
+
+	control := readTarGz(t, data[1])
+	for _, want := range []string{
+		"Package: hello-server\n",
+		"Version: 1.2.3-1\n",
+		"Architecture: amd64\n",
+		"Depends: libc6, ca-certificates\n",
+		"Description: says hello\n",
+	} {
+		if !strings.Contains(control["./control"], want) {
+			t.Errorf("control file doesn't contain %q:\n%s", want, control["./control"])
+		}
+	}
+	if _, ok := control["./postinst"]; !ok {
+		t.Error("no postinst for package with a systemd unit")
+	}
+
+	files := readTarGz(t, data[2])
+	if files["./usr/local/bin/hello"] != string(bin) {
+		t.Errorf("got binary %q; want %q", files["./usr/local/bin/hello"], bin)
+	}
+	if files["./lib/systemd/system/hello-server.service"] != string(p.Unit) {
+		t.Errorf("got unit %q; want %q", files["./lib/systemd/system/hello-server.service"], p.Unit)
+	}
+	for _, dir := range []string{"./", "./usr/", "./usr/local/", "./usr/local/bin/", "./lib/systemd/system/"} {
+		if _, ok := files[dir]; !ok {
+			t.Errorf("data.tar.gz has no entry for %s", dir)
+		}
+	}
+
+	for _, bad := range []func(p *DebPackage){
+		func(p *DebPackage) { p.Name = "Hello" },
+		func(p *DebPackage) { p.Binary = "" },
+		func(p *DebPackage) { p.Binary = "bin/hello" },
+		func(p *DebPackage) { p.Version = "v1.2.3" },
+		func(p *DebPackage) { p.InstallDir = "bin" },
+		func(p *DebPackage) { p.Description = "two\nlines" },
+	} {
+		q := *p
+		bad(&q)
+		if err := q.Write(ioutil.Discard, bin); err == nil {
+			t.Errorf("no error writing bad package %+v", q)
+		}
+	}
+}
+
+// readTarGz returns the contents of the files in the gzipped tar file b,
+// by name. Directories are included, with no contents.
+func readTarGz(t *testing.T, b []byte) map[string]string {
+	t.Helper()
+	gr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(contents)
+	}
+}
+
+// readArMembers returns the names and contents of the members of the ar
+// file read from r, in order.
+func readArMembers(r io.Reader) (names []string, data [][]byte, err error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.HasPrefix(b, []byte("!<arch>\n")) {
+		return nil, nil, fmt.Errorf("not an ar file")
+	}
+	b = b[8:]
+	for len(b) > 0 {
+		if len(b) < 60 {
+			return nil, nil, fmt.Errorf("truncated ar header")
+		}
+		hdr := string(b[:60])
+		var size int
+		if _, err := fmt.Sscanf(strings.TrimSpace(hdr[48:58]), "%d", &size); err != nil {
+			return nil, nil, fmt.Errorf("bad ar member size: %s", err)
+		}
+		b = b[60:]
+		if len(b) < size {
+			return nil, nil, fmt.Errorf("truncated ar member")
+		}
+		names = append(names, strings.TrimSpace(hdr[:16]))
+		data = append(data, b[:size])
+		b = b[size:]
+		if size%2 == 1 && len(b) > 0 {
+			b = b[1:]
+		}
+	}
+	return names, data, nil
+}
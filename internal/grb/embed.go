@@ -0,0 +1,95 @@
+package grb
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// embedFiles returns the names (slash-separated paths) of the files in dir
+// that the //go:embed patterns match, following the rules of go build: a
+// pattern that matches a directory embeds the files in it, recursively,
+// except for those whose names begin with . or _ (unless the pattern has
+// the all: prefix) and those in other modules.
+func embedFiles(dir string, patterns []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, pattern := range patterns {
+		glob := pattern
+		all := strings.HasPrefix(glob, "all:")
+		glob = strings.TrimPrefix(glob, "all:")
+		if _, err := path.Match(glob, ""); err != nil || !validFileName(glob) {
+			return nil, fmt.Errorf("invalid //go:embed pattern %q", pattern)
+		}
+		matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(glob)))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("//go:embed pattern %q in %s matches no files", pattern, dir)
+		}
+		for _, match := range matches {
+			fi, err := os.Lstat(match)
+			if err != nil {
+				return nil, err
+			}
+			if fi.Mode().IsRegular() {
+				rel, err := filepath.Rel(dir, match)
+				if err != nil {
+					return nil, err
+				}
+				add(filepath.ToSlash(rel))
+				continue
+			}
+			if !fi.IsDir() {
+				return nil, fmt.Errorf("cannot embed irregular file %s", match)
+			}
+			err = filepath.Walk(match, func(p string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				base := filepath.Base(p)
+				if p != match {
+					if !all && (strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_")) {
+						if fi.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+					if fi.IsDir() {
+						if _, err := os.Stat(filepath.Join(p, "go.mod")); err == nil {
+							// Another module.
+							return filepath.SkipDir
+						}
+					}
+				}
+				if fi.IsDir() {
+					return nil
+				}
+				if !fi.Mode().IsRegular() {
+					return fmt.Errorf("cannot embed irregular file %s", p)
+				}
+				rel, err := filepath.Rel(dir, p)
+				if err != nil {
+					return err
+				}
+				add(filepath.ToSlash(rel))
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,60 @@
+package grb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEmbedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grb-embed-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{
+		"a.txt",
+		"b.txt",
+		".c.txt",
+		"d/e.txt",
+		"d/.f",
+		"d/_g",
+		"d/h/i.txt",
+		"d/mod/go.mod",
+		"d/mod/j.txt",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		patterns []string
+		want     []string
+	}{
+		{[]string{"a.txt"}, []string{"a.txt"}},
+		{[]string{"*.txt", "a.txt"}, []string{".c.txt", "a.txt", "b.txt"}},
+		{[]string{"d"}, []string{"d/e.txt", "d/h/i.txt"}},
+		{[]string{"all:d"}, []string{"d/.f", "d/_g", "d/e.txt", "d/h/i.txt"}},
+		{[]string{"d/h", "d/.f"}, []string{"d/.f", "d/h/i.txt"}},
+	} {
+		got, err := embedFiles(dir, tt.patterns)
+		if err != nil {
+			t.Errorf("embedFiles(%q): %s", tt.patterns, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("embedFiles(%q) = %q; want %q", tt.patterns, got, tt.want)
+		}
+	}
+	for _, pattern := range []string{"x.txt", "../a.txt", "/a.txt", "d/../a.txt", "[a"} {
+		if _, err := embedFiles(dir, []string{pattern}); err == nil {
+			t.Errorf("embedFiles(%q): got no error", pattern)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package grb
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	gocacheDir = "gocache"
+	// trimInterval is the minimum time between GOCACHE trims.
+	trimInterval = 10 * time.Minute
+)
+
+// toolchain returns a name identifying the server's Go toolchain,
+// suitable for use as a directory name.
+func (s *Server) toolchain() (string, error) {
+	s.toolchainOnce.Do(func() {
+		var out []byte
+		out, s.toolchainErr = s.goCmd("version").Output()
+		if s.toolchainErr != nil {
+			return
+		}
+		// Turn "go version go1.10 linux/amd64" into "go1.10_linux_amd64".
+		v := strings.TrimPrefix(strings.TrimSpace(string(out)), "go version ")
+		s.toolchainName = strings.Map(func(r rune) rune {
+			switch {
+			case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9',
+				r == '.', r == '-':
+				return r
+			}
+			return '_'
+		}, v)
+	})
+	return s.toolchainName, s.toolchainErr
+}
+
+// gocache returns the GOCACHE directory for the server's toolchain.
+// Each toolchain gets its own cache so that upgrading Go on the server
+// doesn't mix build outputs from different versions.
+func (s *Server) gocache() (string, error) {
+	name, err := s.toolchain()
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.Abs(filepath.Join(s.DataDir, gocacheDir, name))
+	if err != nil {
+		return "", err
+	}
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// maybeTrimGOCACHE starts a GOCACHE trim if there hasn't been one recently.
+func (s *Server) maybeTrimGOCACHE() {
+	if s.GOCACHEMaxSize <= 0 {
+		return
+	}
+	s.mu.Lock()
+	if time.Since(s.lastTrim) < trimInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastTrim = time.Now()
+	s.mu.Unlock()
+	go func() {
+		if err := s.trimGOCACHE(); err != nil {
+			log.Println("Error trimming GOCACHE:", err)
+		}
+	}()
+}
+
+type cacheFile struct {
+	path  string
+	size  int64
+	mtime time.Time
+}
+
+// trimGOCACHE deletes the least recently used files from the build caches
+// of all toolchains until their total size is under 90% of GOCACHEMaxSize.
+// (The go command updates the mtime of cache files as it uses them.)
+func (s *Server) trimGOCACHE() error {
+	// Don't delete files out from under running builds, or ones that
+	// builds use or add after the scan below.
+	s.gocacheMu.Lock()
+	defer s.gocacheMu.Unlock()
+
+	root := filepath.Join(s.DataDir, gocacheDir)
+	var files []cacheFile
+	var total int64
+	toolchains, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, tc := range toolchains {
+		if !tc.IsDir() {
+			continue
+		}
+		// Cache entries are in subdirectories named by two hex digits.
+		dirs, err := ioutil.ReadDir(filepath.Join(root, tc.Name()))
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if !dir.IsDir() || len(dir.Name()) != 2 {
+				continue
+			}
+			dirPath := filepath.Join(root, tc.Name(), dir.Name())
+			fis, err := ioutil.ReadDir(dirPath)
+			if err != nil {
+				return err
+			}
+			for _, fi := range fis {
+				if !fi.Mode().IsRegular() {
+					continue
+				}
+				files = append(files, cacheFile{
+					path:  filepath.Join(dirPath, fi.Name()),
+					size:  fi.Size(),
+					mtime: fi.ModTime(),
+				})
+				total += fi.Size()
+			}
+		}
+	}
+	if total <= s.GOCACHEMaxSize {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mtime.Before(files[j].mtime)
+	})
+	deleted, total, err := deleteOldest(files, total, s.GOCACHEMaxSize/10*9)
+	if err != nil {
+		return err
+	}
+	log.Printf("Trimmed GOCACHE: deleted %d files; %d bytes remain", deleted, total)
+	return nil
+}
+
+// deleteOldest deletes files, which are sorted from oldest to newest and
+// have the given total size, until their total size is at most target. It
+// returns the number of files deleted and the size of those that remain.
+func deleteOldest(files []cacheFile, total, target int64) (int, int64, error) {
+	var deleted int
+	for _, f := range files {
+		if total <= target {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return deleted, total, err
+		}
+		total -= f.size
+		deleted++
+	}
+	return deleted, total, nil
+}
@@ -3,12 +3,19 @@ package grb
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"go/build"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 )
 
+// SHA256Header is the HTTP header with which the server sends the hex
+// SHA-256 hash of a build artifact.
+const SHA256Header = "X-Grb-Sha256"
+
 type File struct {
 	Name      string
 	LocalPath string // only used by client
@@ -16,8 +23,9 @@ type File struct {
 }
 
 type Package struct {
-	Name  string
-	Files []File
+	Name    string
+	Version string `json:",omitempty"` // from VCS information, if known
+	Files   []File
 }
 
 func NewPackage(pkg *build.Package) (*Package, error) {
@@ -26,26 +34,122 @@ func NewPackage(pkg *build.Package) (*Package, error) {
 		pkg.GoFiles, pkg.CgoFiles, pkg.CFiles,
 		pkg.CXXFiles, pkg.MFiles, pkg.HFiles, pkg.FFiles, pkg.SFiles,
 		pkg.SwigFiles, pkg.SwigCXXFiles, pkg.SysoFiles,
-		// We need to include ignored Go files for race builds.
-		pkg.IgnoredGoFiles,
 	} {
-		for _, filename := range fs {
-			path := filepath.Join(pkg.Dir, filename)
-			hash, err := hashFile(path)
-			if err != nil {
-				return nil, err
-			}
-			files = append(files, File{
-				Name:      filename,
-				LocalPath: path,
-				Hash:      hash,
-			})
+		fs, err := HashFiles(pkg.Dir, fs)
+		if err != nil {
+			return nil, err
 		}
+		files = append(files, fs...)
 	}
-	return &Package{
+	p := &Package{
 		Name:  pkg.ImportPath,
 		Files: files,
-	}, nil
+	}
+	embeds, err := embedFiles(pkg.Dir, pkg.EmbedPatterns)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.addFiles(pkg.Dir, embeds); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// NewTestPackage is like NewPackage, but it also includes the files needed
+// to test the package: its _test.go files, the files they embed, and
+// everything in its testdata directory.
+func NewTestPackage(pkg *build.Package) (*Package, error) {
+	p, err := NewPackage(pkg)
+	if err != nil {
+		return nil, err
+	}
+	for _, fs := range [][]string{pkg.TestGoFiles, pkg.XTestGoFiles} {
+		fs, err := HashFiles(pkg.Dir, fs)
+		if err != nil {
+			return nil, err
+		}
+		p.Files = append(p.Files, fs...)
+	}
+	var testdata []string
+	err = filepath.Walk(filepath.Join(pkg.Dir, "testdata"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(pkg.Dir, path)
+		if err != nil {
+			return err
+		}
+		testdata = append(testdata, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	embeds, err := embedFiles(pkg.Dir, append(append([]string(nil), pkg.TestEmbedPatterns...), pkg.XTestEmbedPatterns...))
+	if err != nil {
+		return nil, err
+	}
+	for _, names := range [][]string{testdata, embeds} {
+		if err := p.addFiles(pkg.Dir, names); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// addFiles adds the files with the given names in dir to p, skipping any
+// that it already has.
+func (p *Package) addFiles(dir string, names []string) error {
+	have := make(map[string]bool)
+	for _, file := range p.Files {
+		have[file.Name] = true
+	}
+	var add []string
+	for _, name := range names {
+		if !have[name] {
+			have[name] = true
+			add = append(add, name)
+		}
+	}
+	files, err := HashFiles(dir, add)
+	if err != nil {
+		return err
+	}
+	p.Files = append(p.Files, files...)
+	return nil
+}
+
+// HashFiles describes the files with the given names (slash-separated
+// paths) in dir.
+func HashFiles(dir string, names []string) ([]File, error) {
+	var files []File
+	for _, name := range names {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		hash, err := hashFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, File{
+			Name:      name,
+			LocalPath: path,
+			Hash:      hash,
+		})
+	}
+	return files, nil
+}
+
+// validFileName reports whether name, the name of a file in a package, is a
+// clean, slash-separated path within the package directory.
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		path.Clean(name) == name && !path.IsAbs(name) &&
+		!strings.HasPrefix(name, "../") && !strings.Contains(name, "\\")
 }
 
 func hashFile(path string) (string, error) {
@@ -64,11 +168,117 @@ func hashFile(path string) (string, error) {
 
 type BuildRequest struct {
 	PackageName string
-	Packages    []*Package
-	Flags       []string
+	// PackageNames lists the packages to build when building more than one
+	// (or a pattern). PackageName is then empty and the server responds with
+	// a BuildManifest rather than the artifact itself.
+	PackageNames []string `json:",omitempty"`
+	// Targets, if set, lists the platforms to build for, rather than the
+	// server's own. As with PackageNames, the server then responds with
+	// a BuildManifest.
+	Targets  []Target `json:",omitempty"`
+	Packages []*Package
+	Flags    []string
+	// Env sets environment variables, such as CGO_ENABLED, for the build,
+	// as far as the server's BuildEnv policy allows.
+	Env map[string]string `json:",omitempty"`
+	// TestFlags are passed to go test when the packages are tested (with
+	// /test) rather than built. Only some test flags are allowed.
+	TestFlags []string `json:",omitempty"`
+	// RunArgs are the arguments of the binary when it is run on the server
+	// (with /run).
+	RunArgs []string `json:",omitempty"`
+	// Analyzers names extra analyzers, configured on the server, to run
+	// when the packages are vetted (with /vet).
+	Analyzers []string `json:",omitempty"`
+	User      string   // the requesting user, as reported by the client
+
+	remoteIP string // the client's address, recorded by the server
 }
 
 type BuildResponse struct {
 	ID      string
 	Missing []*Package
+	Vulns   []Vuln `json:",omitempty"`
+}
+
+// manifest reports whether the server responds to breq with a
+// BuildManifest.
+func (breq *BuildRequest) manifest() bool {
+	return len(breq.PackageNames) > 0 || len(breq.Targets) > 0
+}
+
+// packageNames returns the packages to build.
+func (breq *BuildRequest) packageNames() []string {
+	if len(breq.PackageNames) > 0 {
+		return breq.PackageNames
+	}
+	return []string{breq.PackageName}
+}
+
+// A Target is a platform to build for.
+type Target struct {
+	GOOS   string
+	GOARCH string
+}
+
+// ParseTarget parses a target written as GOOS/GOARCH.
+func ParseTarget(s string) (Target, error) {
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return Target{}, fmt.Errorf("malformed target %q (want GOOS/GOARCH)", s)
+	}
+	t := Target{GOOS: s[:i], GOARCH: s[i+1:]}
+	if !t.valid() {
+		return Target{}, fmt.Errorf("malformed target %q (want GOOS/GOARCH)", s)
+	}
+	return t, nil
+}
+
+func (t Target) String() string {
+	return t.GOOS + "/" + t.GOARCH
+}
+
+// BinaryName returns the name given to the binary called name when it is
+// built for t as one of several targets.
+func (t Target) BinaryName(name string) string {
+	name += "_" + t.GOOS + "_" + t.GOARCH
+	if t.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func (t Target) valid() bool {
+	for _, s := range []string{t.GOOS, t.GOARCH} {
+		if s == "" || strings.Trim(s, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// An Artifact is a binary produced by a build of several packages or for
+// several targets.
+type Artifact struct {
+	Name    string // file name
+	Package string
+	GOOS    string
+	GOARCH  string
+	Size    int64
+	SHA256  string
+}
+
+// A BuildManifest lists the artifacts of a build of several packages or for
+// several targets. Each can be downloaded from /artifact/<build ID>/<name>
+// for a few minutes after the build.
+type BuildManifest struct {
+	Artifacts []Artifact
+	// Failures lists the targets for which the build failed.
+	Failures []TargetFailure `json:",omitempty"`
+}
+
+// A TargetFailure records the output of a failed build for a target.
+type TargetFailure struct {
+	Target Target
+	Output string
 }
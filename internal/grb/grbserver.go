@@ -1,42 +1,127 @@
 package grb
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"expvar"
 	"fmt"
+	"go/parser"
+	"go/token"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/cespare/hutil"
 )
 
 const (
-	cacheDir    = "cache"
-	gopathDir   = "gopath"
-	hashSize    = sha256.Size * 2 // it's hex
-	buildIDSize = 16 * 2          // also hex
-	timeout     = 5 * time.Minute
+	cacheDir     = "cache"
+	gopathDir    = "gopath"
+	artifactsDir = "artifacts"
+	sandboxDir   = "sandbox"       // where sandboxes mount their root directories
+	hashSize     = sha256.Size * 2 // it's hex
+	buildIDSize  = 16 * 2          // also hex
+	timeout      = 5 * time.Minute
 )
 
 type Server struct {
 	DataDir string
 	Goroot  string
-	Cache   Cache
+	Cache   Store
+
+	// LinkMode is the preferred way of placing cached files into build
+	// trees. The server falls back to other modes as necessary.
+	LinkMode LinkMode
+
+	// Overlay makes the server build from the cache directly using
+	// go build -overlay (Go 1.16+), rather than creating a GOPATH tree
+	// with a link to each file for every build.
+	Overlay bool
+
+	// GOCACHEMaxSize bounds the total size, in bytes, of the build caches
+	// that the server keeps for its toolchains. The caches are trimmed
+	// periodically. If GOCACHEMaxSize is zero, they are never trimmed.
+	GOCACHEMaxSize int64
+
+	// ProvenanceMaxSize bounds the total size, in bytes, of the provenance
+	// documents kept by the server. The oldest are deleted periodically to
+	// stay within it. If ProvenanceMaxSize is zero, they are never deleted.
+	ProvenanceMaxSize int64
+
+	// SigningKey, if set, is used to sign build artifacts.
+	SigningKey ed25519.PrivateKey
+
+	// VulnDB, if set, is used to check the packages in each build for
+	// known vulnerabilities, which are reported to the client.
+	// If FailOnVulns is set, the server refuses to do builds with packages
+	// that are known to be affected (but not those whose versions aren't
+	// known).
+	VulnDB      *VulnDB
+	FailOnVulns bool
+
+	// RunTimeout limits how long a binary run on the server by a client
+	// (with /run) may take. If it is zero (the default), or if the server
+	// can't run binaries in a sandbox on its platform, the server doesn't
+	// run binaries.
+	RunTimeout time.Duration
 
-	mu     sync.Mutex
-	builds map[string]*BuildRequest
+	// TestTimeout limits how long go test may take when run on the server
+	// by a client (with /test). The test binaries run in sandboxes, as
+	// binaries run with /run do. If TestTimeout is zero (the default), or
+	// if the server can't run binaries in a sandbox on its platform, the
+	// server doesn't run tests.
+	TestTimeout time.Duration
+
+	// Analyzers maps the names of extra analyzers that clients may run
+	// with go vet (with /vet) to the vet tools that implement them, such as
+	// binaries built with golang.org/x/tools/go/analysis/unitchecker.
+	Analyzers map[string]string
+
+	// BuildEnv is the policy for the environment variables that clients
+	// may set for builds (with BuildRequest.Env). It maps each variable
+	// that may be set to the values allowed for it, or to nil to allow any
+	// value. Only CGO_ENABLED, CGO_CFLAGS, CGO_LDFLAGS, and CC are ever
+	// allowed. Allowing any value for one of the last three lets clients
+	// run programs on the server.
+	BuildEnv map[string][]string
+
+	linkUnsupported [numLinkModes]int32 // accessed atomically
+
+	toolchainOnce sync.Once
+	toolchainName string
+	toolchainErr  error
+
+	cgoOnce    sync.Once
+	cgoDefault string
+
+	gocacheMu sync.RWMutex // held for writing while trimming the GOCACHE
+
+	mu                 sync.Mutex
+	builds             map[string]*BuildRequest
+	lastTrim           time.Time
+	lastProvenanceTrim time.Time
 }
 
 func NewServer(dataDir, goroot string) (*Server, error) {
-	for _, dir := range []string{gopathDir, cacheDir} {
+	// Artifacts are only kept for a few minutes, so any left over from a
+	// previous run are stale.
+	if err := os.RemoveAll(filepath.Join(dataDir, artifactsDir)); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{gopathDir, cacheDir, provenanceDir, artifactsDir, sandboxDir} {
 		if err := os.MkdirAll(filepath.Join(dataDir, dir), 0755); err != nil {
 			return nil, err
 		}
@@ -44,8 +129,10 @@ func NewServer(dataDir, goroot string) (*Server, error) {
 	return &Server{
 		DataDir: dataDir,
 		Goroot:  goroot,
-		Cache:   Cache(filepath.Join(dataDir, cacheDir)),
-		builds:  make(map[string]*BuildRequest),
+		Cache:   FileStore(filepath.Join(dataDir, cacheDir)),
+		// By default, clients may only turn cgo on or off.
+		BuildEnv: map[string][]string{"CGO_ENABLED": {"0", "1"}},
+		builds:   make(map[string]*BuildRequest),
 	}, nil
 }
 
@@ -56,7 +143,76 @@ func (s *Server) HandleBegin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "malformed BuildRequest: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	for _, t := range breq.Targets {
+		if !t.valid() {
+			http.Error(w, "bad target "+t.String(), http.StatusBadRequest)
+			return
+		}
+	}
+	sent := make(map[string]bool)
+	for _, pkg := range breq.Packages {
+		// A package's name is its directory in the GOPATH.
+		if !validFileName(pkg.Name) {
+			http.Error(w, "bad package name "+pkg.Name, http.StatusBadRequest)
+			return
+		}
+		sent[pkg.Name] = true
+		for _, file := range pkg.Files {
+			if !validFileName(file.Name) {
+				http.Error(w, "bad file name "+file.Name, http.StatusBadRequest)
+				return
+			}
+			// The hash names the file in the cache.
+			if !isHash(file.Hash) {
+				http.Error(w, "bad hash for file "+file.Name, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	// The packages to build go on the go command line after the flags,
+	// so they must not look like flags themselves.
+	if breq.PackageName != "" && len(breq.PackageNames) > 0 {
+		http.Error(w, "PackageName and PackageNames are both set", http.StatusBadRequest)
+		return
+	}
+	for _, name := range breq.packageNames() {
+		if strings.HasPrefix(name, "-") || !validFileName(name) || !sent[name] {
+			http.Error(w, "bad package to build "+name, http.StatusBadRequest)
+			return
+		}
+	}
+	if err := s.checkBuildEnv(breq.Env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CheckBuildFlags(breq.Flags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkTestFlags(breq.TestFlags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, name := range breq.Analyzers {
+		if _, ok := s.Analyzers[name]; !ok {
+			http.Error(w, "no such analyzer "+name, http.StatusBadRequest)
+			return
+		}
+	}
+	var vulns []Vuln
+	if s.VulnDB != nil {
+		vulns = s.VulnDB.Check(breq.Packages)
+		if s.FailOnVulns && AnyAffected(vulns) {
+			w.Header().Set("Content-Type", "text/plain")
+			// As with compile errors, use 412 to say that the build
+			// can't proceed.
+			w.WriteHeader(412)
+			fmt.Fprintf(w, "refusing to build packages with known vulnerabilities:\n%s", VulnReport(vulns))
+			return
+		}
+	}
 
+	breq.remoteIP = hutil.RemoteIP(r).String()
 	id := randomString(buildIDSize / 2)
 	s.mu.Lock()
 	s.builds[id] = &breq
@@ -67,7 +223,7 @@ func (s *Server) HandleBegin(w http.ResponseWriter, r *http.Request) {
 		s.mu.Unlock()
 	})
 
-	missing, err := s.Cache.FindMissing(breq.Packages)
+	missing, err := FindMissing(s.Cache, breq.Packages)
 	if err != nil {
 		log.Println("/begin error:", err)
 		http.Error(w, "womp womp", 500)
@@ -76,6 +232,7 @@ func (s *Server) HandleBegin(w http.ResponseWriter, r *http.Request) {
 	br := &BuildResponse{
 		ID:      id,
 		Missing: missing,
+		Vulns:   vulns,
 	}
 	encoder := json.NewEncoder(w)
 	if err := encoder.Encode(br); err != nil {
@@ -86,8 +243,8 @@ func (s *Server) HandleBegin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) HandleUpload(w http.ResponseWriter, r *http.Request, hash string) {
-	if len(hash) != hashSize {
-		http.Error(w, "bad hash size", http.StatusBadRequest)
+	if !isHash(hash) {
+		http.Error(w, "bad hash", http.StatusBadRequest)
 		return
 	}
 	if err := s.Cache.Put(hash, r.Body); err != nil {
@@ -98,18 +255,28 @@ func (s *Server) HandleUpload(w http.ResponseWriter, r *http.Request, hash strin
 }
 
 func (s *Server) HandleBuild(w http.ResponseWriter, buildID string) {
+	breq, ok := s.lookupBuild(w, buildID)
+	if !ok {
+		return
+	}
+	s.Build(w, buildID, breq)
+}
+
+// lookupBuild finds the BuildRequest for buildID. If there is none, it writes
+// an error to w and returns false.
+func (s *Server) lookupBuild(w http.ResponseWriter, buildID string) (*BuildRequest, bool) {
 	if len(buildID) != buildIDSize {
 		http.Error(w, "bad build id", http.StatusBadRequest)
-		return
+		return nil, false
 	}
 	s.mu.Lock()
 	breq, ok := s.builds[buildID]
 	s.mu.Unlock()
 	if !ok {
 		http.Error(w, "no such build", http.StatusBadRequest)
-		return
+		return nil, false
 	}
-	s.Build(w, buildID, breq)
+	return breq, true
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -137,6 +304,74 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.HandleBuild(w, rest)
 		return
 	}
+	if rest, ok := trimPrefix(r.URL.Path, "/test/"); ok {
+		if r.Method != "GET" {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		s.HandleTest(w, r, rest)
+		return
+	}
+	if rest, ok := trimPrefix(r.URL.Path, "/vet/"); ok {
+		if r.Method != "GET" {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		s.HandleVet(w, rest)
+		return
+	}
+	if rest, ok := trimPrefix(r.URL.Path, "/run/"); ok {
+		if r.Method != "GET" {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		s.HandleRun(w, r, rest)
+		return
+	}
+	if rest, ok := trimPrefix(r.URL.Path, "/artifact/"); ok {
+		if r.Method != "GET" {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		s.HandleArtifact(w, rest)
+		return
+	}
+	if rest, ok := trimPrefix(r.URL.Path, "/verify/"); ok {
+		if r.Method != "GET" {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		s.HandleVerify(w, rest)
+		return
+	}
+	if rest, ok := trimPrefix(r.URL.Path, "/provenance/"); ok {
+		if r.Method != "GET" {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		s.HandleProvenance(w, rest)
+		return
+	}
+	if rest, ok := trimPrefix(r.URL.Path, "/sbom/"); ok {
+		if r.Method != "GET" {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		s.HandleSBOM(w, rest)
+		return
+	}
+	if r.URL.Path == "/pubkey" {
+		if r.Method != "GET" {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		s.HandlePublicKey(w)
+		return
+	}
+	if r.URL.Path == "/debug/vars" {
+		expvar.Handler().ServeHTTP(w, r)
+		return
+	}
 	if r.URL.Path == "/version" {
 		if r.Method != "GET" {
 			http.Error(w, "bad method", http.StatusMethodNotAllowed)
@@ -166,8 +401,22 @@ func (s *Server) HandleVersion(w http.ResponseWriter) {
 
 func (s *Server) HandleVersionJSON(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"GOOS":%q,"GOARCH":%q,"Version":%q}`,
-		runtime.GOOS, runtime.GOARCH, runtime.Version())
+	fmt.Fprintf(w, `{"GOOS":%q,"GOARCH":%q,"Version":%q,"CgoEnabled":%q}`,
+		runtime.GOOS, runtime.GOARCH, runtime.Version(), s.cgoEnabled())
+}
+
+// cgoEnabled returns the default CGO_ENABLED setting ("1" or "0") of the
+// server's go command for its own platform, or "" if it's unknown.
+func (s *Server) cgoEnabled() string {
+	s.cgoOnce.Do(func() {
+		out, err := s.goCmd("env", "CGO_ENABLED").Output()
+		if err != nil {
+			log.Println("Error calling 'go env CGO_ENABLED':", err)
+			return
+		}
+		s.cgoDefault = strings.TrimSpace(string(out))
+	})
+	return s.cgoDefault
 }
 
 func (s *Server) goCmd(args ...string) *exec.Cmd {
@@ -176,64 +425,432 @@ func (s *Server) goCmd(args ...string) *exec.Cmd {
 		bin = filepath.Join(s.Goroot, "bin", "go")
 	}
 	cmd := exec.Command(bin, args...)
+	cmd.Env = os.Environ()
 	if s.Goroot != "" {
-		cmd.Env = append(os.Environ(), "GOROOT="+s.Goroot)
+		cmd.Env = append(cmd.Env, "GOROOT="+s.Goroot)
 	}
 	return cmd
 }
 
 func (s *Server) Build(w http.ResponseWriter, buildID string, breq *BuildRequest) {
-	root := filepath.Join(s.DataDir, gopathDir, buildID+"."+randomString(4))
+	if breq.manifest() {
+		s.buildMany(w, buildID, breq)
+		return
+	}
+	started := time.Now()
+	root, bin, err := s.compile(buildID, breq, false)
 	defer os.RemoveAll(root)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
 
-	if err := s.buildGOPATH(breq, root); err != nil {
-		log.Println("Error building GOPATH:", err)
-		http.Error(w, "error creating build", http.StatusInternalServerError)
+	f, err := os.Open(bin)
+	if err != nil {
+		log.Println("Error opening executable:", err)
+		http.Error(w, "error with build", http.StatusInternalServerError)
 		return
 	}
-	args := []string{"build", "-o", buildID}
-	args = append(args, breq.Flags...)
-	args = append(args, breq.PackageName)
-	cmd := s.goCmd(args...)
-	cmd.Dir = root
-	gopath, err := filepath.Abs(root)
+	defer f.Close()
+	size, hash, err := hashArtifact(f)
 	if err != nil {
-		log.Println("Error building GOPATH:", err)
-		http.Error(w, "error creating build", http.StatusInternalServerError)
+		log.Println("Error reading executable:", err)
+		http.Error(w, "error with build", http.StatusInternalServerError)
 		return
 	}
-	cmd.Env = append(cmd.Env, "GOPATH="+gopath)
-	out, err := cmd.CombinedOutput()
+	a := Artifact{
+		Package: breq.PackageName,
+		GOOS:    runtime.GOOS,
+		GOARCH:  runtime.GOARCH,
+		Size:    size,
+		SHA256:  hash,
+	}
+	if err := s.writeProvenance(buildID, breq, started, []Artifact{a}); err != nil {
+		log.Println("Error writing provenance:", err)
+		http.Error(w, "error with build", http.StatusInternalServerError)
+		return
+	}
+	s.serveArtifact(w, f, a, buildID, breq.Flags)
+}
+
+// buildMany builds several packages and/or for several targets at once. The
+// binaries are kept in the artifacts directory for a while so that the
+// client can download them after reading the manifest. A compile error for
+// one target doesn't stop the others from being built.
+func (s *Server) buildMany(w http.ResponseWriter, buildID string, breq *BuildRequest) {
+	started := time.Now()
+	root, overlay, err := s.prepareBuild(buildID, breq)
+	defer os.RemoveAll(root)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/octet-stream")
-		// We use http status 412 to indicate compile errors.
-		w.WriteHeader(412)
-		w.Write(out)
+		writeBuildError(w, err)
 		return
 	}
 
-	f, err := os.Open(filepath.Join(root, buildID))
+	dir, err := s.newArtifactsDir(buildID)
 	if err != nil {
-		log.Println("Error opening executable:", err)
+		log.Println("Error creating artifacts directory:", err)
+		http.Error(w, "error with build", http.StatusInternalServerError)
+		return
+	}
+	targets := breq.Targets
+	if len(targets) == 0 {
+		targets = []Target{{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}}
+	}
+	var manifest BuildManifest
+	for _, t := range targets {
+		// With a trailing slash, go build writes every command to the
+		// directory.
+		binDir := filepath.Join("bin", t.GOOS+"_"+t.GOARCH) + string(filepath.Separator)
+		var env []string
+		if len(breq.Targets) > 0 {
+			env = []string{"GOOS=" + t.GOOS, "GOARCH=" + t.GOARCH}
+		}
+		if err := s.goBuild(root, overlay, breq, false, binDir, env...); err != nil {
+			ce, ok := err.(*compileError)
+			if !ok || len(breq.Targets) == 0 {
+				writeBuildError(w, err)
+				return
+			}
+			manifest.Failures = append(manifest.Failures, TargetFailure{t, string(ce.out)})
+			continue
+		}
+		for _, pkg := range breq.packageNames() {
+			bin := path.Base(pkg)
+			if t.GOOS == "windows" {
+				bin += ".exe"
+			}
+			name := bin
+			if len(breq.Targets) > 0 {
+				name = t.BinaryName(path.Base(pkg))
+			}
+			a, err := storeArtifact(filepath.Join(root, binDir, bin), filepath.Join(dir, name))
+			if err != nil {
+				if os.IsNotExist(err) {
+					// Not a command.
+					continue
+				}
+				log.Println("Error storing executable:", err)
+				http.Error(w, "error with build", http.StatusInternalServerError)
+				return
+			}
+			a.Name = name
+			a.Package = pkg
+			a.GOOS = t.GOOS
+			a.GOARCH = t.GOARCH
+			manifest.Artifacts = append(manifest.Artifacts, a)
+		}
+	}
+	if err := s.writeProvenance(buildID, breq, started, manifest.Artifacts); err != nil {
+		log.Println("Error writing provenance:", err)
 		http.Error(w, "error with build", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&manifest); err != nil {
+		log.Println("/build error:", err)
+	}
+}
+
+// newArtifactsDir creates the directory for the artifacts of buildID, which is
+// removed after a while.
+func (s *Server) newArtifactsDir(buildID string) (string, error) {
+	dir := filepath.Join(s.DataDir, artifactsDir, buildID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	time.AfterFunc(timeout, func() {
+		os.RemoveAll(dir)
+	})
+	return dir, nil
+}
+
+// storeArtifact moves the binary at src to dest and returns its size and
+// hash.
+func storeArtifact(src, dest string) (Artifact, error) {
+	if err := os.Rename(src, dest); err != nil {
+		return Artifact{}, err
+	}
+	f, err := os.Open(dest)
+	if err != nil {
+		return Artifact{}, err
+	}
 	defer f.Close()
+	size, hash, err := hashArtifact(f)
+	if err != nil {
+		return Artifact{}, err
+	}
+	return Artifact{Size: size, SHA256: hash}, nil
+}
+
+// HandleArtifact serves one of the artifacts listed in a BuildManifest.
+// rest is <build ID>/<name>.
+func (s *Server) HandleArtifact(w http.ResponseWriter, rest string) {
+	i := strings.IndexByte(rest, '/')
+	if i < 0 {
+		http.Error(w, "not found", 404)
+		return
+	}
+	buildID, name := rest[:i], rest[i+1:]
+	b, ok := s.readProvenance(w, buildID)
+	if !ok {
+		return
+	}
+	var p Provenance
+	if err := json.Unmarshal(b, &p); err != nil {
+		log.Println("Error decoding provenance:", err)
+		http.Error(w, "error reading provenance", http.StatusInternalServerError)
+		return
+	}
+	for _, a := range p.Artifacts {
+		if a.Name != name {
+			continue
+		}
+		f, err := os.Open(filepath.Join(s.DataDir, artifactsDir, buildID, a.Name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, "artifact has expired", http.StatusNotFound)
+				return
+			}
+			log.Println("Error opening artifact:", err)
+			http.Error(w, "error reading artifact", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		s.serveArtifact(w, f, a, buildID, p.Flags)
+		return
+	}
+	http.Error(w, "no such artifact", http.StatusNotFound)
+}
+
+// hashArtifact returns the size and hex SHA-256 hash of f, leaving f
+// positioned at the start.
+func hashArtifact(f *os.File) (size int64, hash string, err error) {
+	h := sha256.New()
+	size, err = io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// serveArtifact sends the build artifact f, described by a, to the client,
+// along with its size and SHA-256 hash so the client can check that it was
+// received intact and, if the server has a signing key, a signature.
+func (s *Server) serveArtifact(w http.ResponseWriter, f *os.File, a Artifact, buildID string, flags []string) {
+	if err := s.signArtifact(w.Header(), buildID, a, flags); err != nil {
+		log.Println("Error signing executable:", err)
+		http.Error(w, "error with build", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set(SHA256Header, a.SHA256)
 	if _, err := io.Copy(w, f); err != nil {
 		log.Println("Error sending executable to client:", err)
 	}
 }
 
-func (s *Server) buildGOPATH(breq *BuildRequest, root string) error {
+// A compileError is a failure of go build itself (such as a type error in the
+// code being built), as opposed to a failure to set up the build.
+type compileError struct {
+	out []byte
+}
+
+func (e *compileError) Error() string {
+	return "go build failed:\n" + string(e.out)
+}
+
+func writeBuildError(w http.ResponseWriter, err error) {
+	if ce, ok := err.(*compileError); ok {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// We use http status 412 to indicate compile errors.
+		w.WriteHeader(412)
+		w.Write(ce.out)
+		return
+	}
+	log.Println("Build error:", err)
+	http.Error(w, "error creating build", http.StatusInternalServerError)
+}
+
+// compile builds breq in a new GOPATH. It returns the root of the GOPATH,
+// which the caller must remove (even if there's an error), and the path of
+// the resulting binary. If freshCache is set, the build uses a new, empty
+// GOCACHE inside the root rather than the server's cache for its toolchain.
+func (s *Server) compile(buildID string, breq *BuildRequest, freshCache bool) (root, bin string, err error) {
+	root, overlay, err := s.prepareBuild(buildID, breq)
+	if err != nil {
+		return root, "", err
+	}
+	if err := s.goBuild(root, overlay, breq, freshCache, buildID); err != nil {
+		return root, "", err
+	}
+	return root, filepath.Join(root, buildID), nil
+}
+
+// prepareBuild creates a new GOPATH with the sources of breq. It returns
+// the root of the GOPATH, which the caller must remove (even if there's an
+// error), and the overlay file to pass to go build, if any.
+func (s *Server) prepareBuild(buildID string, breq *BuildRequest) (root, overlay string, err error) {
+	root, err = s.newRoot(buildID)
+	if err != nil {
+		return "", "", err
+	}
+	overlay, err = s.buildTree(breq, root)
+	if err != nil {
+		return root, "", fmt.Errorf("error building GOPATH: %s", err)
+	}
+	return root, overlay, nil
+}
+
+// newRoot returns a new directory in which to create a GOPATH for buildID.
+func (s *Server) newRoot(buildID string) (string, error) {
+	return filepath.Abs(filepath.Join(s.DataDir, gopathDir, buildID+"."+randomString(4)))
+}
+
+// goBuild runs go build for breq in the GOPATH at root, writing the output
+// to output (relative to root). env is added to the environment of the
+// build.
+func (s *Server) goBuild(root, overlay string, breq *BuildRequest, freshCache bool, output string, env ...string) error {
+	gocache := filepath.Join(root, "gocache")
+	if !freshCache {
+		var err error
+		gocache, err = s.gocache()
+		if err != nil {
+			return fmt.Errorf("error creating GOCACHE: %s", err)
+		}
+	}
+	args := []string{"build", "-o", output}
+	if overlay != "" {
+		args = append(args, "-overlay", overlay)
+	}
+	args = append(args, breq.Flags...)
+	args = append(args, breq.packageNames()...)
+	cmd := s.goCmd(args...)
+	cmd.Dir = root
+	cmd.Env = append(cmd.Env, goEnv(root, gocache)...)
+	cmd.Env = append(cmd.Env, breq.environ()...)
+	cmd.Env = append(cmd.Env, env...)
+	s.gocacheMu.RLock()
+	out, err := cmd.CombinedOutput()
+	s.gocacheMu.RUnlock()
+	s.maybeTrimGOCACHE()
+	if err != nil {
+		return &compileError{out}
+	}
+	return nil
+}
+
+// goEnv returns the environment for running the go command in the GOPATH at
+// root.
+func goEnv(root, gocache string) []string {
+	return []string{
+		"GOPATH=" + root,
+		"GOCACHE=" + gocache,
+		// The build tree is a GOPATH, not a module.
+		"GO111MODULE=off",
+	}
+}
+
+// buildTree prepares the GOPATH at root for building breq. If the server
+// uses overlays, it returns the overlay file to pass to go build;
+// otherwise, it populates the GOPATH with the source files.
+func (s *Server) buildTree(breq *BuildRequest, root string) (overlay string, err error) {
+	if ls, ok := s.Cache.(LocalStore); ok && s.Overlay {
+		return s.buildOverlay(breq, root, ls)
+	}
+	return "", s.buildGOPATH(breq, root, s.LinkMode)
+}
+
+// buildOverlay writes an overlay file for go build -overlay which places the
+// cached source files of breq in a virtual GOPATH at root.
+func (s *Server) buildOverlay(breq *BuildRequest, root string, ls LocalStore) (string, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", err
+	}
+	overlay := struct {
+		Replace map[string]string
+	}{make(map[string]string)}
+	for _, pkg := range breq.Packages {
+		// The go command runs cgo in the package directory, so it must
+		// exist.
+		dir := filepath.Join(root, "src", pkg.Name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+		for _, file := range pkg.Files {
+			cached, err := ls.LocalPath(file.Hash)
+			if err != nil {
+				return "", err
+			}
+			// Only Go files are read through the overlay. Others, such
+			// as C headers (which may be included from other
+			// directories) and profiles, must be on disk, and so must
+			// cgo files, since cgo only accepts files named *.go.
+			if !strings.HasSuffix(file.Name, ".go") || usesCgo(cached) {
+				dest := filepath.Join(dir, file.Name)
+				if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+					return "", err
+				}
+				if err := s.materialize(file.Hash, dest); err != nil {
+					return "", err
+				}
+				continue
+			}
+			// Relative paths in the overlay would be interpreted relative to
+			// the build directory.
+			cached, err = filepath.Abs(cached)
+			if err != nil {
+				return "", err
+			}
+			overlay.Replace[filepath.Join(root, "src", pkg.Name, file.Name)] = cached
+		}
+	}
+	b, err := json.Marshal(&overlay)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(root, "overlay.json")
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return "", err
+	}
+	materializeStats.Add("overlay", int64(len(overlay.Replace)))
+	return path, nil
+}
+
+// usesCgo reports whether the Go file at path imports "C".
+func usesCgo(path string) bool {
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.ImportsOnly)
+	if err != nil {
+		// Let go build report the problem.
+		return false
+	}
+	for _, imp := range f.Imports {
+		if imp.Path.Value == `"C"` {
+			return true
+		}
+	}
+	return false
+}
+
+// buildGOPATH populates the GOPATH at root with the source files of breq,
+// placing them with mode or one of the modes that follow it.
+func (s *Server) buildGOPATH(breq *BuildRequest, root string, mode LinkMode) error {
 	for _, pkg := range breq.Packages {
 		if err := os.MkdirAll(filepath.Join(root, "src", pkg.Name), 0755); err != nil {
 			return err
 		}
 		for _, file := range pkg.Files {
-			cached := s.Cache.Path(file.Hash)
 			dest := filepath.Join(root, "src", pkg.Name, file.Name)
-			if err := os.Link(cached, dest); err != nil {
+			if strings.Contains(file.Name, "/") {
+				// A file in a subdirectory, such as testdata.
+				if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+					return err
+				}
+			}
+			if err := s.materializeWith(file.Hash, dest, mode); err != nil {
 				return err
 			}
 		}
@@ -256,3 +873,17 @@ func randomString(n int) string {
 	}
 	return hex.EncodeToString(s)
 }
+
+// isHash reports whether s looks like a hex SHA-256 hash.
+func isHash(s string) bool {
+	return len(s) == hashSize && isHex(s)
+}
+
+// isBuildID reports whether s looks like a build ID.
+func isBuildID(s string) bool {
+	return len(s) == buildIDSize && isHex(s)
+}
+
+func isHex(s string) bool {
+	return strings.Trim(s, "0123456789abcdef") == ""
+}
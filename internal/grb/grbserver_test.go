@@ -0,0 +1,245 @@
+package grb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// BenchmarkBuildTree compares the cost of preparing a build of a large
+// dependency graph using a GOPATH tree and using an overlay.
+func BenchmarkBuildTree(b *testing.B) {
+	const (
+		numPackages = 200
+		numFiles    = 20
+	)
+	dir, err := ioutil.TempDir("", "grb-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := FileStore(filepath.Join(dir, "cache"))
+	if err := os.Mkdir(string(cache), 0755); err != nil {
+		b.Fatal(err)
+	}
+	breq := &BuildRequest{PackageName: "p0"}
+	for i := 0; i < numPackages; i++ {
+		pkg := &Package{Name: fmt.Sprintf("example.com/p%d", i)}
+		for j := 0; j < numFiles; j++ {
+			data := fmt.Sprintf("package p%d // file %d\n", i, j)
+			hash := hashBytes([]byte(data))
+			if err := cache.Put(hash, strings.NewReader(data)); err != nil {
+				b.Fatal(err)
+			}
+			pkg.Files = append(pkg.Files, File{
+				Name: fmt.Sprintf("f%d.go", j),
+				Hash: hash,
+			})
+		}
+		breq.Packages = append(breq.Packages, pkg)
+	}
+
+	for _, overlay := range []bool{false, true} {
+		name := "gopath"
+		if overlay {
+			name = "overlay"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := &Server{Cache: cache, Overlay: overlay}
+			for i := 0; i < b.N; i++ {
+				root := filepath.Join(dir, fmt.Sprintf("root%d", i))
+				if _, err := s.buildTree(breq, root); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				os.RemoveAll(root)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestTrimGOCACHE(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grb-gocache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files in two toolchains' caches, each 100 bytes, from oldest to newest.
+	now := time.Now()
+	var paths []string
+	for i, name := range []string{
+		"go1.9_linux_amd64/00/a-d",
+		"go1.10_linux_amd64/01/b-d",
+		"go1.9_linux_amd64/02/c-a",
+		"go1.10_linux_amd64/03/d-d",
+		"go1.10_linux_amd64/04/e-a",
+	} {
+		path := filepath.Join(dir, gocacheDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i-10) * time.Hour)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	s := &Server{DataDir: dir, GOCACHEMaxSize: 400}
+	if err := s.trimGOCACHE(); err != nil {
+		t.Fatal(err)
+	}
+	// 90% of 400 is 360, so the two oldest files should be gone.
+	for i, path := range paths {
+		_, err := os.Stat(path)
+		if exists := err == nil; exists != (i >= 2) {
+			t.Errorf("%s: exists=%t after trim", path, exists)
+		}
+	}
+}
+
+func TestTrimProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grb-provenance-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewServer(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ProvenanceMaxSize = 300
+
+	// Four 100-byte documents, from oldest to newest.
+	now := time.Now()
+	var paths []string
+	for i := 0; i < 4; i++ {
+		path := s.provenancePath(randomString(buildIDSize / 2))
+		if err := ioutil.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i-10) * time.Hour)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	if err := s.trimProvenance(); err != nil {
+		t.Fatal(err)
+	}
+	// 90% of 300 is 270, so the two oldest documents should be gone.
+	for i, path := range paths {
+		_, err := os.Stat(path)
+		if exists := err == nil; exists != (i >= 2) {
+			t.Errorf("%s: exists=%t after trim", path, exists)
+		}
+	}
+}
+
+func TestBeginHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grb-begin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewServer(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		hash string
+		ok   bool
+	}{
+		{strings.Repeat("a", hashSize), true},
+		{"", false},
+		{"ab", false},
+		{"../../../../etc/passwd", false},
+		{strings.Repeat("../", hashSize/3) + "x", false},
+		{strings.Repeat("A", hashSize), false},
+	} {
+		breq := &BuildRequest{
+			PackageName: "p",
+			Packages: []*Package{{
+				Name:  "p",
+				Files: []File{{Name: "p.go", Hash: tt.hash}},
+			}},
+		}
+		b, err := json.Marshal(breq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/begin", bytes.NewReader(b)))
+		want := http.StatusBadRequest
+		if tt.ok {
+			want = http.StatusOK
+		}
+		if w.Code != want {
+			t.Errorf("with hash %q: got status %d; want %d", tt.hash, w.Code, want)
+		}
+	}
+}
+
+func TestBeginPackageNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grb-begin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewServer(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs := func(names ...string) []*Package {
+		var pkgs []*Package
+		for _, name := range names {
+			pkgs = append(pkgs, &Package{
+				Name:  name,
+				Files: []File{{Name: "x.go", Hash: strings.Repeat("a", hashSize)}},
+			})
+		}
+		return pkgs
+	}
+	for _, tt := range []struct {
+		breq *BuildRequest
+		ok   bool
+	}{
+		{&BuildRequest{PackageName: "p", Packages: pkgs("p")}, true},
+		{&BuildRequest{PackageNames: []string{"p", "q"}, Packages: pkgs("p", "q", "r")}, true},
+		{&BuildRequest{Packages: pkgs("p")}, false},
+		{&BuildRequest{PackageName: "q", Packages: pkgs("p")}, false},
+		{&BuildRequest{PackageName: "-toolexec=/bin/true", Packages: pkgs("p")}, false},
+		{&BuildRequest{PackageName: "-x", Packages: pkgs("-x")}, false},
+		{&BuildRequest{PackageName: "../p", Packages: pkgs("p")}, false},
+		{&BuildRequest{PackageNames: []string{"-toolexec=/usr/bin/touch /tmp/x", "p"}, Packages: pkgs("p")}, false},
+		{&BuildRequest{PackageName: "p", PackageNames: []string{"q"}, Packages: pkgs("p", "q")}, false},
+	} {
+		b, err := json.Marshal(tt.breq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/begin", bytes.NewReader(b)))
+		want := http.StatusBadRequest
+		if tt.ok {
+			want = http.StatusOK
+		}
+		if w.Code != want {
+			t.Errorf("with PackageName=%q, PackageNames=%q: got status %d; want %d",
+				tt.breq.PackageName, tt.breq.PackageNames, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package grb
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// A LinkMode says how the server places cached files into build trees.
+// When a mode isn't possible (for instance, hard links between filesystems
+// or reflinks on a filesystem without copy-on-write support), the server
+// falls back to the next mode: hard links, then reflinks, then copies.
+type LinkMode int
+
+const (
+	LinkHard LinkMode = iota
+	LinkReflink
+	LinkCopy
+	numLinkModes
+)
+
+var linkModeNames = [numLinkModes]string{"hardlink", "reflink", "copy"}
+
+func (m LinkMode) String() string {
+	if m < 0 || m >= numLinkModes {
+		return fmt.Sprintf("LinkMode(%d)", int(m))
+	}
+	return linkModeNames[m]
+}
+
+// ParseLinkMode parses the name of a LinkMode ("hardlink", "reflink", or
+// "copy").
+func ParseLinkMode(s string) (LinkMode, error) {
+	for m, name := range linkModeNames {
+		if s == name {
+			return LinkMode(m), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown link mode %q", s)
+}
+
+// materializeStats counts the files placed into build trees by each
+// LinkMode, as well as the number of fallbacks from one mode to the next.
+var materializeStats = expvar.NewMap("grb_materialize")
+
+// materialize creates dest with the contents of the cached blob for hash.
+func (s *Server) materialize(hash, dest string) error {
+	return s.materializeWith(hash, dest, s.LinkMode)
+}
+
+// materializeWith is like materialize but tries mode (and the modes that
+// follow it), rather than s.LinkMode, first.
+func (s *Server) materializeWith(hash, dest string, mode LinkMode) error {
+	ls, ok := s.Cache.(LocalStore)
+	if !ok {
+		rc, err := s.Cache.Open(hash)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		if err := copyToNew(dest, rc); err != nil {
+			return err
+		}
+		materializeStats.Add(LinkCopy.String(), 1)
+		return nil
+	}
+	cached, err := ls.LocalPath(hash)
+	if err != nil {
+		return err
+	}
+	for ; mode < LinkCopy; mode++ {
+		if atomic.LoadInt32(&s.linkUnsupported[mode]) != 0 {
+			continue
+		}
+		var err error
+		switch mode {
+		case LinkHard:
+			err = os.Link(cached, dest)
+		case LinkReflink:
+			err = reflink(cached, dest)
+		}
+		if err == nil {
+			materializeStats.Add(mode.String(), 1)
+			return nil
+		}
+		materializeStats.Add("fallback", 1)
+		if linkUnsupported(err) && atomic.CompareAndSwapInt32(&s.linkUnsupported[mode], 0, 1) {
+			log.Printf("Cannot use %s to build trees (%s); falling back", mode, err)
+		}
+	}
+	f, err := os.Open(cached)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := copyToNew(dest, f); err != nil {
+		return err
+	}
+	materializeStats.Add(LinkCopy.String(), 1)
+	return nil
+}
+
+// linkUnsupported reports whether err indicates that a link mode cannot work
+// at all, rather than that it failed for a particular file.
+func linkUnsupported(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.EXDEV, syscall.EPERM, syscall.ENOTSUP, syscall.EOPNOTSUPP,
+		syscall.EINVAL, syscall.ENOTTY, syscall.ENOSYS,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return errors.Is(err, errReflinkUnsupported)
+}
+
+var errReflinkUnsupported = errors.New("reflinks are not supported on this platform")
+
+// copyToNew writes the contents of r to dest, which must not already exist.
+// (It might be a hard link into the cache from a failed link attempt, in
+// which case truncating it would be disastrous.)
+func copyToNew(dest string, r io.Reader) error {
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(dest)
+		return err
+	}
+	return f.Close()
+}
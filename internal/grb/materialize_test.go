@@ -0,0 +1,88 @@
+package grb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaterialize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grb-materialize-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := FileStore(filepath.Join(dir, "cache"))
+	if err := os.Mkdir(string(cache), 0755); err != nil {
+		t.Fatal(err)
+	}
+	const data = "package p\n"
+	hash := hashBytes([]byte(data))
+	if err := cache.Put(hash, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		store       Store
+		mode        LinkMode
+		unsupported []LinkMode
+		wantLink    bool
+	}{
+		{store: cache, mode: LinkHard, wantLink: true},
+		{store: cache, mode: LinkReflink},
+		{store: cache, mode: LinkCopy},
+		{store: cache, mode: LinkHard, unsupported: []LinkMode{LinkHard}},
+		{store: cache, mode: LinkHard, unsupported: []LinkMode{LinkHard, LinkReflink}},
+		// A Store that isn't a LocalStore is always copied from.
+		{store: struct{ Store }{cache}, mode: LinkHard},
+	} {
+		s := &Server{Cache: tt.store, LinkMode: tt.mode}
+		for _, m := range tt.unsupported {
+			s.linkUnsupported[m] = 1
+		}
+		dest := filepath.Join(dir, fmt.Sprintf("dest%d", i))
+		if err := s.materialize(hash, dest); err != nil {
+			t.Fatalf("[%d] materialize: %s", i, err)
+		}
+		b, err := ioutil.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Errorf("[%d] got contents %q; want %q", i, b, data)
+		}
+		fi1, err := os.Stat(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi2, err := os.Stat(cache.Path(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := os.SameFile(fi1, fi2); got != tt.wantLink {
+			t.Errorf("[%d] dest is a hard link to the cache: got %t; want %t", i, got, tt.wantLink)
+		}
+	}
+
+	// materialize must never clobber an existing file
+	// (which could be a link to the cache).
+	s := &Server{Cache: cache, LinkMode: LinkCopy}
+	if err := s.materialize(hash, filepath.Join(dir, "dest0")); err == nil {
+		t.Fatal("materialize onto an existing file succeeded")
+	}
+}
+
+func TestParseLinkMode(t *testing.T) {
+	for m := LinkHard; m < numLinkModes; m++ {
+		got, err := ParseLinkMode(m.String())
+		if err != nil || got != m {
+			t.Errorf("ParseLinkMode(%q): got (%s, %v); want %s", m, got, err, m)
+		}
+	}
+	if _, err := ParseLinkMode("symlink"); err == nil {
+		t.Error("ParseLinkMode(symlink): got nil error")
+	}
+}
@@ -0,0 +1,271 @@
+package grb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"time"
+)
+
+// OCI media types.
+const (
+	ociManifestType  = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType    = "application/vnd.oci.image.config.v1+json"
+	ociLayerType     = "application/vnd.oci.image.layer.v1.tar"
+	ociLayerGzipType = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// An Image describes a container image holding a single executable, which
+// is the image's entrypoint.
+type Image struct {
+	Ref        string // the image's name in the layout, such as hello:latest
+	BinaryPath string // where the executable is installed, such as /usr/local/bin/hello
+	GOOS       string
+	GOARCH     string
+	Labels     map[string]string
+	// BaseLayer, if set, is a layer (a tar file, possibly gzipped) placed
+	// beneath the executable. Otherwise, the image has just the executable.
+	BaseLayer []byte
+	Time      time.Time
+}
+
+// ErrDynamicBinary is returned when trying to make an image with no base
+// layer from a dynamically linked executable, which couldn't run in it.
+var ErrDynamicBinary = errors.New("executable is dynamically linked, so the image needs a base layer")
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociConfig struct {
+	Created      string `json:"created"`
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Config       struct {
+		Env        []string          `json:"Env"`
+		Entrypoint []string          `json:"Entrypoint"`
+		Labels     map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// Write writes img, containing the executable bin, to w as a tar file in the
+// OCI image layout format.
+func (img *Image) Write(w io.Writer, bin []byte) error {
+	if !path.IsAbs(img.BinaryPath) {
+		return errors.New("image binary path must be absolute")
+	}
+	if img.BaseLayer == nil && isDynamic(bin) {
+		return ErrDynamicBinary
+	}
+	mtime := img.Time
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	mtime = mtime.UTC().Truncate(time.Second)
+	blobs := make(map[string][]byte)
+	addBlob := func(mediaType string, b []byte) ociDescriptor {
+		digest := "sha256:" + sha256Hex(b)
+		blobs[digest] = b
+		return ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(b))}
+	}
+
+	var layers []ociDescriptor
+	var diffIDs []string
+	if img.BaseLayer != nil {
+		layer, diffID, gzipped, err := inspectLayer(img.BaseLayer)
+		if err != nil {
+			return err
+		}
+		mediaType := ociLayerType
+		if gzipped {
+			mediaType = ociLayerGzipType
+		}
+		layers = append(layers, addBlob(mediaType, layer))
+		diffIDs = append(diffIDs, diffID)
+	}
+	layer, diffID, err := binaryLayer(img.BinaryPath, bin, mtime)
+	if err != nil {
+		return err
+	}
+	layers = append(layers, addBlob(ociLayerGzipType, layer))
+	diffIDs = append(diffIDs, diffID)
+
+	var config ociConfig
+	config.Created = mtime.Format(time.RFC3339)
+	config.Architecture = img.GOARCH
+	config.OS = img.GOOS
+	config.Config.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+	config.Config.Entrypoint = []string{img.BinaryPath}
+	config.Config.Labels = img.Labels
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = diffIDs
+	b, err := json.Marshal(&config)
+	if err != nil {
+		return err
+	}
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		Config:        addBlob(ociConfigType, b),
+		Layers:        layers,
+	}
+	b, err = json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+	desc := addBlob(ociManifestType, b)
+	desc.Platform = &ociPlatform{Architecture: img.GOARCH, OS: img.GOOS}
+	if img.Ref != "" {
+		desc.Annotations = map[string]string{"org.opencontainers.image.ref.name": img.Ref}
+	}
+	index, err := json.Marshal(&ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{desc}})
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	writeFile := func(name string, b []byte) error {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(b)),
+			ModTime: mtime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+	if err := writeFile("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+	if err := writeFile("index.json", index); err != nil {
+		return err
+	}
+	// Write the blobs in a fixed order so that the output is reproducible.
+	for _, d := range append(append(layers, manifest.Config), desc) {
+		if err := writeFile("blobs/sha256/"+d.Digest[len("sha256:"):], blobs[d.Digest]); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// binaryLayer returns a gzipped layer holding bin at binPath and the digest
+// of the uncompressed layer.
+func binaryLayer(binPath string, bin []byte, mtime time.Time) (layer []byte, diffID string, err error) {
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	var dirs []string
+	for dir := path.Dir(binPath); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	for _, dir := range dirs {
+		hdr := &tar.Header{
+			Name:     dir[1:] + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			ModTime:  mtime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, "", err
+		}
+	}
+	hdr := &tar.Header{
+		Name:    binPath[1:],
+		Mode:    0755,
+		Size:    int64(len(bin)),
+		ModTime: mtime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, "", err
+	}
+	if _, err := tw.Write(bin); err != nil {
+		return nil, "", err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, "", err
+	}
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	if _, err := gw.Write(tarBuf.Bytes()); err != nil {
+		return nil, "", err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, "", err
+	}
+	return gzBuf.Bytes(), "sha256:" + sha256Hex(tarBuf.Bytes()), nil
+}
+
+// inspectLayer checks that b is a (possibly gzipped) tar file and returns
+// it along with the digest of the uncompressed tar file.
+func inspectLayer(b []byte) (layer []byte, diffID string, gzipped bool, err error) {
+	uncompressed := b
+	if bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		gzipped = true
+		gr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, "", false, err
+		}
+		uncompressed, err = ioutil.ReadAll(gr)
+		if err != nil {
+			return nil, "", false, err
+		}
+	}
+	tr := tar.NewReader(bytes.NewReader(uncompressed))
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", false, errors.New("base layer is not a tar file: " + err.Error())
+		}
+	}
+	return b, "sha256:" + sha256Hex(uncompressed), gzipped, nil
+}
+
+// isDynamic reports whether bin is a dynamically linked ELF executable.
+func isDynamic(bin []byte) bool {
+	f, err := elf.NewFile(bytes.NewReader(bin))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package grb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImage(t *testing.T) {
+	var base bytes.Buffer
+	gw := gzip.NewWriter(&base)
+	tw := tar.NewWriter(gw)
+	passwd := []byte("root:x:0:0:root:/root:/bin/sh\n")
+	tw.WriteHeader(&tar.Header{Name: "etc/passwd", Mode: 0644, Size: int64(len(passwd))})
+	tw.Write(passwd)
+	tw.Close()
+	gw.Close()
+
+	img := &Image{
+		Ref:        "hello:latest",
+		BinaryPath: "/usr/local/bin/hello",
+		GOOS:       "linux",
+		GOARCH:     "arm64",
+		Labels:     map[string]string{"org.opencontainers.image.title": "hello"},
+		BaseLayer:  base.Bytes(),
+		Time:       time.Unix(1500000000, 0),
+	}
+	bin := []byte("not really a binary")
+	var buf bytes.Buffer
+	if err := img.Write(&buf, bin); err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = b
+	}
+	if _, ok := files["oci-layout"]; !ok {
+		t.Fatal("no oci-layout file")
+	}
+	// Every blob must match its digest.
+	blob := func(digest string) []byte {
+		t.Helper()
+		b, ok := files["blobs/sha256/"+strings.TrimPrefix(digest, "sha256:")]
+		if !ok {
+			t.Fatalf("no blob for %s", digest)
+		}
+		if "sha256:"+sha256Hex(b) != digest {
+			t.Fatalf("blob %s has digest sha256:%s", digest, sha256Hex(b))
+		}
+		return b
+	}
+
+	var index ociIndex
+	if err := json.Unmarshal(files["index.json"], &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("got %d manifests; want 1", len(index.Manifests))
+	}
+	desc := index.Manifests[0]
+	if desc.Annotations["org.opencontainers.image.ref.name"] != "hello:latest" ||
+		desc.Platform == nil || desc.Platform.Architecture != "arm64" {
+		t.Errorf("bad manifest descriptor %+v", desc)
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(blob(desc.Digest), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	var config ociConfig
+	if err := json.Unmarshal(blob(manifest.Config.Digest), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.OS != "linux" || config.Architecture != "arm64" ||
+		strings.Join(config.Config.Entrypoint, " ") != "/usr/local/bin/hello" ||
+		config.Config.Labels["org.opencontainers.image.title"] != "hello" {
+		t.Errorf("bad config %+v", config)
+	}
+	if len(manifest.Layers) != 2 || len(config.RootFS.DiffIDs) != 2 {
+		t.Fatalf("got %d layers and %d diff IDs; want 2", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+	for i, layer := range manifest.Layers {
+		gr, err := gzip.NewReader(bytes.NewReader(blob(layer.Digest)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(gr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := "sha256:"+sha256Hex(b), config.RootFS.DiffIDs[i]; got != want {
+			t.Errorf("layer %d has diff ID %s; config says %s", i, got, want)
+		}
+	}
+}
+
+func TestImageDynamic(t *testing.T) {
+	bin, err := ioutil.ReadFile("/bin/sh")
+	if err != nil || !isDynamic(bin) {
+		t.Skip("no dynamically linked executable to test with")
+	}
+	img := &Image{BinaryPath: "/sh", GOOS: "linux", GOARCH: "amd64"}
+	if err := img.Write(ioutil.Discard, bin); err != ErrDynamicBinary {
+		t.Fatalf("got err=%v; want %v", err, ErrDynamicBinary)
+	}
+}
@@ -0,0 +1,188 @@
+package grb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+const provenanceDir = "provenance"
+
+// Provenance records how an artifact was built, so that it can be traced
+// back to its exact sources. The server keeps the provenance of every
+// successful build, deleting the oldest to stay within ProvenanceMaxSize.
+type Provenance struct {
+	BuildID   string
+	Package   string
+	Packages  []string `json:",omitempty"` // for builds of several packages
+	Targets   []Target `json:",omitempty"` // for builds for several targets
+	GOOS      string
+	GOARCH    string
+	Flags     []string
+	Env       map[string]string `json:",omitempty"`
+	TestFlags []string          `json:",omitempty"` // for the outputs of a test run
+	Toolchain string
+
+	User     string // as reported by the client
+	RemoteIP string
+
+	Started  time.Time
+	Finished time.Time
+
+	Artifact struct {
+		Size   int64
+		SHA256 string
+	}
+	// Artifacts, instead of Artifact, describes the binaries of a build of
+	// several packages or for several targets, or the outputs of a test run.
+	Artifacts []Artifact `json:",omitempty"`
+
+	// Inputs lists every source file used in the build.
+	Inputs []*Package
+}
+
+func (s *Server) writeProvenance(buildID string, breq *BuildRequest, started time.Time, artifacts []Artifact) error {
+	toolchain, err := s.toolchain()
+	if err != nil {
+		return err
+	}
+	p := &Provenance{
+		BuildID:   buildID,
+		Package:   breq.PackageName,
+		Packages:  breq.PackageNames,
+		Targets:   breq.Targets,
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		Flags:     breq.Flags,
+		Env:       breq.Env,
+		TestFlags: breq.TestFlags,
+		Toolchain: toolchain,
+		User:      breq.User,
+		RemoteIP:  breq.remoteIP,
+		Started:   started.UTC(),
+		Finished:  time.Now().UTC(),
+	}
+	if breq.manifest() || len(breq.TestFlags) > 0 {
+		p.Artifacts = artifacts
+	} else {
+		p.Artifact.Size = artifacts[0].Size
+		p.Artifact.SHA256 = artifacts[0].SHA256
+	}
+	for _, pkg := range breq.Packages {
+		input := &Package{Name: pkg.Name, Version: pkg.Version}
+		for _, file := range pkg.Files {
+			// The client's local paths are none of our business.
+			input.Files = append(input.Files, File{Name: file.Name, Hash: file.Hash})
+		}
+		p.Inputs = append(p.Inputs, input)
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write and rename so that a partial document is never served.
+	path := s.provenancePath(buildID)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	s.maybeTrimProvenance()
+	return nil
+}
+
+// maybeTrimProvenance starts a trim of the provenance documents if there
+// hasn't been one recently.
+func (s *Server) maybeTrimProvenance() {
+	if s.ProvenanceMaxSize <= 0 {
+		return
+	}
+	s.mu.Lock()
+	if time.Since(s.lastProvenanceTrim) < trimInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastProvenanceTrim = time.Now()
+	s.mu.Unlock()
+	go func() {
+		if err := s.trimProvenance(); err != nil {
+			log.Println("Error trimming provenance:", err)
+		}
+	}()
+}
+
+// trimProvenance deletes the oldest provenance documents until their total
+// size is under 90% of ProvenanceMaxSize.
+func (s *Server) trimProvenance() error {
+	dir := filepath.Join(s.DataDir, provenanceDir)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []cacheFile
+	var total int64
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		files = append(files, cacheFile{
+			path:  filepath.Join(dir, fi.Name()),
+			size:  fi.Size(),
+			mtime: fi.ModTime(),
+		})
+		total += fi.Size()
+	}
+	if total <= s.ProvenanceMaxSize {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mtime.Before(files[j].mtime)
+	})
+	deleted, total, err := deleteOldest(files, total, s.ProvenanceMaxSize/10*9)
+	if err != nil {
+		return err
+	}
+	log.Printf("Trimmed provenance: deleted %d documents; %d bytes remain", deleted, total)
+	return nil
+}
+
+func (s *Server) provenancePath(buildID string) string {
+	return filepath.Join(s.DataDir, provenanceDir, buildID+".json")
+}
+
+func (s *Server) HandleProvenance(w http.ResponseWriter, buildID string) {
+	b, ok := s.readProvenance(w, buildID)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// readProvenance reads the provenance of the build with the given ID.
+// If it can't, it writes an error to w and returns false.
+func (s *Server) readProvenance(w http.ResponseWriter, buildID string) ([]byte, bool) {
+	if !isBuildID(buildID) {
+		http.Error(w, "bad build id", http.StatusBadRequest)
+		return nil, false
+	}
+	b, err := ioutil.ReadFile(s.provenancePath(buildID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "no provenance for build", http.StatusNotFound)
+			return nil, false
+		}
+		log.Println("Error reading provenance:", err)
+		http.Error(w, "error reading provenance", http.StatusInternalServerError)
+		return nil, false
+	}
+	return b, true
+}
@@ -0,0 +1,28 @@
+package grb
+
+import (
+	"os"
+	"syscall"
+)
+
+const ficlone = 0x40049409 // FICLONE from linux/fs.h
+
+// reflink creates dest as a copy-on-write clone of src.
+func reflink(src, dest string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	d, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.Fd(), ficlone, s.Fd())
+	if errno != 0 {
+		d.Close()
+		os.Remove(dest)
+		return &os.LinkError{Op: "reflink", Old: src, New: dest, Err: errno}
+	}
+	return d.Close()
+}
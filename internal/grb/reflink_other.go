@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package grb
+
+func reflink(src, dest string) error {
+	return errReflinkUnsupported
+}
@@ -0,0 +1,130 @@
+package grb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// A RunEvent is a chunk of the output of a binary run on the server.
+type RunEvent struct {
+	Stream string // "stdout" or "stderr"
+	Data   []byte
+}
+
+// HandleRun builds the package of a build, runs the binary with the build's
+// RunArgs, and streams its output to the client as RunEvents, each holding
+// a chunk of output as the binary wrote it (not necessarily whole lines).
+// The binary runs in a sandbox (so this is only possible on Linux), in an
+// empty directory with a minimal environment, and is killed if it takes
+// longer than RunTimeout or the client goes away. Once it exits, its status
+// is sent in the ExitStatusTrailer trailer.
+func (s *Server) HandleRun(w http.ResponseWriter, r *http.Request, buildID string) {
+	if s.RunTimeout == 0 || !sandboxSupported {
+		http.Error(w, "this server doesn't run binaries", http.StatusForbidden)
+		return
+	}
+	breq, ok := s.lookupBuild(w, buildID)
+	if !ok {
+		return
+	}
+	if breq.manifest() {
+		http.Error(w, "can only run a build of a single package for the server's platform", http.StatusBadRequest)
+		return
+	}
+	root, bin, err := s.compile(buildID, breq, false)
+	defer os.RemoveAll(root)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	dir := filepath.Join(root, "run")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		log.Println("Error creating run directory:", err)
+		http.Error(w, "error running binary", http.StatusInternalServerError)
+		return
+	}
+
+	cmd := exec.Command(bin, breq.RunArgs...)
+	cmd.Dir = dir
+	cmd.Env = sandboxEnv(dir)
+	es := &eventStream{w: w}
+	cmd.Stdout = &runWriter{es, "stdout"}
+	cmd.Stderr = &runWriter{es, "stderr"}
+	if err := sandbox(cmd, filepath.Join(s.DataDir, sandboxDir), dir); err != nil {
+		log.Println("Error creating sandbox:", err)
+		http.Error(w, "error running binary", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Trailer", ExitStatusTrailer)
+	if err := cmd.Start(); err != nil {
+		log.Println("Error starting binary in sandbox:", err)
+		http.Error(w, "error running binary", http.StatusInternalServerError)
+		return
+	}
+	err = waitLimited(r.Context(), cmd, s.RunTimeout, func() {
+		msg := fmt.Sprintf("grb: killed after the time limit of %s\n", s.RunTimeout)
+		es.writeEvent(&RunEvent{Stream: "stderr", Data: []byte(msg)})
+	})
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			log.Println("Error running binary:", err)
+			return
+		}
+	}
+	setExitStatus(w, cmd)
+}
+
+// sandboxEnv returns the minimal environment of a binary run in a sandbox in
+// dir.
+func sandboxEnv(dir string) []string {
+	return []string{
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+		"HOME=" + dir,
+		"TMPDIR=" + dir,
+	}
+}
+
+// waitLimited waits for cmd, which was started in a sandbox or in a new
+// process group, killing it along with everything it started if it takes
+// longer than limit (in which case timedOut is called first) or if ctx is
+// done.
+func waitLimited(ctx context.Context, cmd *exec.Cmd, limit time.Duration, timedOut func()) error {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		timer := time.NewTimer(limit)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			timedOut()
+			killSandbox(cmd.Process)
+		case <-ctx.Done():
+			killSandbox(cmd.Process)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	<-stopped
+	return err
+}
+
+// A runWriter sends what's written to it as RunEvents for one of the output
+// streams of a binary.
+type runWriter struct {
+	es     *eventStream
+	stream string
+}
+
+func (rw *runWriter) Write(p []byte) (int, error) {
+	rw.es.writeEvent(&RunEvent{Stream: rw.stream, Data: p})
+	return len(p), nil
+}
@@ -0,0 +1,292 @@
+package grb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Store is a Store which keeps blobs in a bucket of an S3-compatible
+// object store. It uses path-style requests and AWS Signature Version 4,
+// which work with S3 itself as well as with most work-alikes (MinIO, Ceph,
+// and so on).
+type S3Store struct {
+	Endpoint     string // such as https://s3.us-east-1.amazonaws.com
+	Region       string
+	Bucket       string
+	Prefix       string // prepended to each hash to form the object key
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // optional
+
+	Client *http.Client // if nil, http.DefaultClient is used
+}
+
+// emptyHash is the SHA-256 hash of an empty payload.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3Store) Put(hash string, r io.Reader) error {
+	// Spool to disk first so that we never store a blob whose hash doesn't
+	// match and so we can send the Content-Length that S3 requires.
+	f, err := ioutil.TempFile("", "grbs3")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	h := sha256.New()
+	n, err := io.Copy(f, io.TeeReader(r, h))
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return errHashMismatch
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := s.do("PUT", s.key(hash), nil, ioutil.NopCloser(f), n, hash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return s3Error("PUT", hash, resp)
+	}
+	return nil
+}
+
+func (s *S3Store) Has(hash string) (bool, error) {
+	resp, err := s.do("HEAD", s.key(hash), nil, nil, 0, emptyHash)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, s3Error("HEAD", hash, resp)
+}
+
+func (s *S3Store) Open(hash string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.key(hash), nil, nil, 0, emptyHash)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case 200:
+		return resp.Body, nil
+	case 404:
+		resp.Body.Close()
+		return nil, &os.PathError{Op: "open", Path: s.key(hash), Err: os.ErrNotExist}
+	}
+	resp.Body.Close()
+	return nil, s3Error("GET", hash, resp)
+}
+
+func (s *S3Store) Delete(hash string) error {
+	resp, err := s.do("DELETE", s.key(hash), nil, nil, 0, emptyHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case 200, 204, 404:
+		return nil
+	}
+	return s3Error("DELETE", hash, resp)
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Store) Walk(fn func(hash string) error) error {
+	var token string
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.Prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, 0, emptyHash)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return s3Error("LIST", s.Prefix, resp)
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, obj := range result.Contents {
+			hash := strings.TrimPrefix(obj.Key, s.Prefix)
+			if !isHash(hash) {
+				continue
+			}
+			if err := fn(hash); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Store) key(hash string) string {
+	return s.Prefix + hash
+}
+
+func s3Error(op, key string, resp *http.Response) error {
+	return fmt.Errorf("S3 %s %s: unexpected status %s", op, key, resp.Status)
+}
+
+// do makes a signed request for key (or the bucket itself, if key is empty).
+// payloadHash is the hex SHA-256 hash of body.
+func (s *S3Store) do(method, key string, query url.Values, body io.ReadCloser, size int64, payloadHash string) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = body
+		req.ContentLength = size
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	io.WriteString(h, data)
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Escape URI-encodes path as SigV4 requires: every byte except the
+// unreserved characters and '/' is percent-encoded.
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+strings.Replace(s3Escape(v), "/", "%2F", -1))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,393 @@
+package grb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const sandboxSupported = true
+
+// sandboxInitArg is the argument with which the server runs itself to set up
+// a sandbox from inside its namespaces, and sandboxExecArg the one with which
+// go test runs it (using -exec) to run a test binary in a sandbox.
+const (
+	sandboxInitArg = "-grb-sandbox-init"
+	sandboxExecArg = "-grb-sandbox-exec"
+)
+
+func init() {
+	if len(os.Args) < 2 {
+		return
+	}
+	switch os.Args[1] {
+	case sandboxInitArg:
+		os.Exit(sandboxInit(os.Args[2:]))
+	case sandboxExecArg:
+		os.Exit(sandboxExec(os.Args[2:]))
+	}
+}
+
+// sandbox sets up cmd to run in new user, mount, PID, network, IPC, and UTS
+// namespaces, so that it can't reach the network or see or signal other
+// processes, and in its own process group so that killSandbox can kill
+// everything it starts. This needs unprivileged user namespaces.
+//
+// The sandbox's filesystem holds only read-only views of the system
+// directories and of cmd.Path, and dir, which is writable. Its root is
+// mounted (in the new mount namespace) on mnt, an existing directory.
+func sandbox(cmd *exec.Cmd, mnt, dir string) error {
+	mnt, err := filepath.Abs(mnt)
+	if err != nil {
+		return err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	bin, err := filepath.Abs(cmd.Path)
+	if err != nil {
+		return err
+	}
+	// The sandbox is set up by a copy of the server, which then runs
+	// cmd.Path.
+	cmd.Args = append([]string{"grb", sandboxInitArg, mnt, dir, bin}, cmd.Args[1:]...)
+	cmd.Path = "/proc/self/exe"
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		// The setup process is root in the namespace so that it can
+		// mount the sandbox's filesystem.
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	return nil
+}
+
+// killSandbox kills a process started in a sandbox (or by newProcessGroup),
+// along with its children.
+func killSandbox(p *os.Process) {
+	syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
+// newProcessGroup sets up cmd to run in its own process group, so that
+// killSandbox can kill it along with any sandboxes that it starts.
+func newProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// sandboxTestExec returns the value of the go test -exec flag which runs test
+// binaries in sandboxes mounted on mnt with the writable directory dir,
+// which must hold the test binaries and the packages' directories.
+func sandboxTestExec(mnt, dir string) (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	mnt, err = filepath.Abs(mnt)
+	if err != nil {
+		return "", err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	// The go command splits the value into fields, which may be quoted
+	// but not escaped.
+	var fields []string
+	for _, f := range []string{self, sandboxExecArg, mnt, dir} {
+		if strings.ContainsRune(f, '\'') {
+			return "", fmt.Errorf("cannot pass %q to go test -exec", f)
+		}
+		fields = append(fields, "'"+f+"'")
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// sandboxExec is run by go test with the arguments mnt, dir, a test binary,
+// and its arguments. It runs the test binary in a sandbox as sandbox does
+// and returns its exit status.
+func sandboxExec(args []string) int {
+	if len(args) < 3 {
+		fmt.Fprintln(os.Stderr, "grb: bad sandbox arguments")
+		return 1
+	}
+	mnt, dir := args[0], args[1]
+	cmd := exec.Command(args[2], args[3:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = sandboxEnv(dir)
+	// go test tells test binaries built with -cover where to write
+	// coverage data (in dir) with GOCOVERDIR.
+	if v, ok := os.LookupEnv("GOCOVERDIR"); ok {
+		cmd.Env = append(cmd.Env, "GOCOVERDIR="+v)
+	}
+	if err := sandbox(cmd, mnt, dir); err != nil {
+		fmt.Fprintln(os.Stderr, "grb: error creating sandbox:", err)
+		return 1
+	}
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			fmt.Fprintln(os.Stderr, "grb: error running test binary in sandbox:", err)
+			return 1
+		}
+	}
+	return exitStatus(cmd.ProcessState)
+}
+
+// sandboxInit is run by the server in a new sandbox with the arguments
+// mnt, dir, bin, and bin's arguments. It sets up the sandbox's filesystem
+// and runs bin, returning its exit status.
+func sandboxInit(args []string) int {
+	if len(args) < 3 {
+		fmt.Fprintln(os.Stderr, "grb: bad sandbox arguments")
+		return 1
+	}
+	mnt, dir, bin := args[0], args[1], args[2]
+	if err := enterSandbox(mnt, dir, bin); err != nil {
+		fmt.Fprintln(os.Stderr, "grb: error setting up sandbox:", err)
+		return 1
+	}
+	uid, err := outsideID("/proc/self/uid_map")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "grb: error setting up sandbox:", err)
+		return 1
+	}
+	gid, err := outsideID("/proc/self/gid_map")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "grb: error setting up sandbox:", err)
+		return 1
+	}
+	cmd := exec.Command(bin, args[3:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+		// Run bin as the server's user in a nested user namespace, so
+		// that it has no privileges over the sandbox's mounts and can't
+		// make them writable.
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: uid, HostID: 0, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: gid, HostID: 0, Size: 1}},
+	}
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			fmt.Fprintln(os.Stderr, "grb: error running binary in sandbox:", err)
+			return 1
+		}
+	}
+	// As PID 1 of the sandbox, this process can't be killed by a signal
+	// that it sends itself, so it reports one with the status the shell
+	// would use.
+	return exitStatus(cmd.ProcessState)
+}
+
+// outsideID returns the ID outside the user namespace that ID 0 inside is
+// mapped to by the uid_map or gid_map file name.
+func outsideID(name string) (int, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 3 || fields[0] != "0" {
+		return 0, fmt.Errorf("unexpected ID map %q", b)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// sandboxPaths are the system files and directories that are visible
+// (read-only) in a sandbox, if they exist. Programs may need these to load
+// shared libraries, look up users, and so on.
+var sandboxPaths = []string{
+	"/bin",
+	"/sbin",
+	"/lib",
+	"/lib32",
+	"/lib64",
+	"/libx32",
+	"/usr",
+	"/etc/alternatives",
+	"/etc/group",
+	"/etc/hosts",
+	"/etc/ld.so.cache",
+	"/etc/ld.so.conf",
+	"/etc/ld.so.conf.d",
+	"/etc/localtime",
+	"/etc/nsswitch.conf",
+	"/etc/passwd",
+	"/etc/ssl",
+}
+
+// sandboxDevices are the devices available in a sandbox.
+var sandboxDevices = []string{
+	"/dev/full",
+	"/dev/null",
+	"/dev/random",
+	"/dev/urandom",
+	"/dev/zero",
+}
+
+// enterSandbox makes a read-only tmpfs mounted on mnt the root directory of
+// the process, holding sandboxPaths, sandboxDevices, bin, and dir (which is
+// writable), each at its usual path, as well as /proc. The process must be
+// in new user, mount, and PID namespaces, and its working directory must be
+// in dir.
+func enterSandbox(mnt, dir, bin string) error {
+	// The working directory must be in dir, where it's found again in the
+	// sandbox. Since getcwd returns a path without symlinks, compare it
+	// with dir likewise.
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if wd, err = filepath.EvalSymlinks(wd); err != nil {
+		return err
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if !within(realDir, wd) {
+		return fmt.Errorf("working directory %s is not in %s", wd, dir)
+	}
+	rel, err := filepath.Rel(realDir, wd)
+	if err != nil {
+		return err
+	}
+
+	// Keep the sandbox's mounts out of the server's mount namespace.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %s", err)
+	}
+	if err := syscall.Mount("tmpfs", mnt, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting tmpfs: %s", err)
+	}
+	for _, p := range sandboxPaths {
+		if err := bindMount(mnt, p, true); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, p := range sandboxDevices {
+		if err := bindMount(mnt, p, false); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !within(dir, bin) {
+		if err := bindMount(mnt, bin, true); err != nil {
+			return err
+		}
+	}
+	if err := bindMount(mnt, dir, false); err != nil {
+		return err
+	}
+	proc := filepath.Join(mnt, "proc")
+	if err := os.Mkdir(proc, 0755); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if err := syscall.Mount("proc", proc, "proc", flags, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %s", err)
+	}
+
+	// Switch to the new root and detach the old one, which pivot_root
+	// stacks underneath it.
+	if err := os.Chdir(mnt); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %s", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching old root: %s", err)
+	}
+	flags = syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV
+	if err := syscall.Mount("", "/", "", flags, ""); err != nil {
+		return fmt.Errorf("making root read-only: %s", err)
+	}
+	return os.Chdir(filepath.Join(dir, rel))
+}
+
+// bindMount makes the file or directory p visible at the same path under
+// root. A symlink is copied instead.
+func bindMount(root, p string, readOnly bool) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(root, p)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dest)
+	case fi.IsDir():
+		if err := os.Mkdir(dest, 0755); err != nil {
+			return err
+		}
+	default:
+		if err := ioutil.WriteFile(dest, nil, 0644); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount(p, dest, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mounting %s: %s", p, err)
+	}
+	if !readOnly {
+		return nil
+	}
+	// A bind mount can only be made read-only by remounting it, which
+	// must keep the restrictions of the original mount (as the
+	// kernel won't lift them in a user namespace).
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for _, f := range []struct{ st, ms uintptr }{
+		{stNoSUID, syscall.MS_NOSUID},
+		{stNoDev, syscall.MS_NODEV},
+		{stNoExec, syscall.MS_NOEXEC},
+		{stNoAtime, syscall.MS_NOATIME},
+		{stNoDirAtime, syscall.MS_NODIRATIME},
+		{stRelAtime, syscall.MS_RELATIME},
+	} {
+		if uintptr(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	if err := syscall.Mount("", dest, "", flags, ""); err != nil {
+		return fmt.Errorf("making %s read-only: %s", p, err)
+	}
+	return nil
+}
+
+// Mount flags reported by statfs (ST_* in <sys/statvfs.h>).
+const (
+	stNoSUID     = 0x2
+	stNoDev      = 0x4
+	stNoExec     = 0x8
+	stNoAtime    = 0x400
+	stNoDirAtime = 0x800
+	stRelAtime   = 0x1000
+)
+
+// within reports whether the path p is in the directory dir.
+func within(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
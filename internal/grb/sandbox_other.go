@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package grb
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// Binaries can only be run in a sandbox on Linux.
+const sandboxSupported = false
+
+func sandbox(cmd *exec.Cmd, mnt, dir string) error {
+	return errors.New("sandboxes are not supported on this platform")
+}
+
+func killSandbox(p *os.Process) {
+	p.Kill()
+}
+
+func newProcessGroup(cmd *exec.Cmd) {}
+
+func sandboxTestExec(mnt, dir string) (string, error) {
+	return "", errors.New("sandboxes are not supported on this platform")
+}
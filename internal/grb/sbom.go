@@ -0,0 +1,166 @@
+package grb
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The SBOM types are a subset of the CycloneDX 1.5 JSON format.
+// See https://cyclonedx.org/docs/1.5/json/.
+
+type SBOM struct {
+	BOMFormat    string        `json:"bomFormat"`
+	SpecVersion  string        `json:"specVersion"`
+	SerialNumber string        `json:"serialNumber"`
+	Version      int           `json:"version"`
+	Metadata     SBOMMetadata  `json:"metadata"`
+	Components   []*Component  `json:"components"`
+	Dependencies []*Dependency `json:"dependencies,omitempty"`
+}
+
+type SBOMMetadata struct {
+	Timestamp string     `json:"timestamp"`
+	Tools     []SBOMTool `json:"tools"`
+	Component *Component `json:"component"`
+}
+
+type SBOMTool struct {
+	Name string `json:"name"`
+}
+
+type Component struct {
+	Type       string       `json:"type"`
+	BOMRef     string       `json:"bom-ref,omitempty"`
+	Name       string       `json:"name"`
+	Version    string       `json:"version,omitempty"`
+	PURL       string       `json:"purl,omitempty"`
+	Hashes     []SBOMHash   `json:"hashes,omitempty"`
+	Properties []Property   `json:"properties,omitempty"`
+	Components []*Component `json:"components,omitempty"`
+}
+
+type SBOMHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type Property struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type Dependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// NewSBOM creates a software bill of materials for the artifact described by
+// p. It lists every package that went into the build (other than the
+// standard library) along with its version, if known, and the hashes of its
+// files.
+func NewSBOM(p *Provenance) *SBOM {
+	sbom := &SBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + buildUUID(p.BuildID),
+		Version:      1,
+		Metadata: SBOMMetadata{
+			Timestamp: p.Finished.UTC().Format(time.RFC3339),
+			Tools:     []SBOMTool{{Name: "grb"}},
+		},
+	}
+	main := &Dependency{Ref: "build:" + p.BuildID}
+	for _, pkg := range p.Inputs {
+		c := &Component{
+			Type:    "library",
+			BOMRef:  pkg.Name,
+			Name:    importPath(pkg.Name),
+			Version: pkg.Version,
+			PURL:    "pkg:golang/" + importPath(pkg.Name),
+		}
+		if pkg.Version != "" {
+			c.PURL += "@" + pkg.Version
+		}
+		for _, file := range pkg.Files {
+			c.Components = append(c.Components, &Component{
+				Type:   "file",
+				Name:   file.Name,
+				Hashes: []SBOMHash{{Alg: "SHA-256", Content: file.Hash}},
+			})
+		}
+		sbom.Components = append(sbom.Components, c)
+		main.DependsOn = append(main.DependsOn, c.BOMRef)
+	}
+	sbom.Metadata.Component = &Component{
+		Type:   "application",
+		BOMRef: main.Ref,
+		Name:   p.Package,
+		Hashes: []SBOMHash{{Alg: "SHA-256", Content: p.Artifact.SHA256}},
+		Properties: []Property{
+			{"grb:buildID", p.BuildID},
+			{"grb:toolchain", p.Toolchain},
+			{"grb:platform", p.GOOS + "/" + p.GOARCH},
+			{"grb:flags", strings.Join(p.Flags, " ")},
+		},
+	}
+	if len(p.Artifacts) > 0 {
+		// A build of several packages or for several targets is
+		// described as an application made up of its binaries.
+		meta := sbom.Metadata.Component
+		if len(p.Packages) > 0 {
+			meta.Name = strings.Join(p.Packages, " ")
+		}
+		meta.Hashes = nil
+		for _, a := range p.Artifacts {
+			meta.Components = append(meta.Components, &Component{
+				Type:       "application",
+				Name:       a.Package,
+				Hashes:     []SBOMHash{{Alg: "SHA-256", Content: a.SHA256}},
+				Properties: []Property{{"grb:platform", a.GOOS + "/" + a.GOARCH}},
+			})
+		}
+	}
+	sbom.Dependencies = []*Dependency{main}
+	return sbom
+}
+
+// importPath returns the path by which the package in dir (relative to a
+// GOPATH src directory) is imported, removing any vendor directory prefix.
+func importPath(dir string) string {
+	if i := strings.LastIndex(dir, "/vendor/"); i >= 0 {
+		return dir[i+len("/vendor/"):]
+	}
+	return strings.TrimPrefix(dir, "vendor/")
+}
+
+// buildUUID formats a build ID (16 random bytes) as a version 4 UUID.
+func buildUUID(buildID string) string {
+	b := []byte(buildID)
+	b[12] = '4' // version
+	// The variant's top two bits are 10.
+	b[16] = "89ab"[strings.IndexByte("0123456789abcdef", b[16])%4]
+	return fmt.Sprintf("%s-%s-%s-%s-%s", b[:8], b[8:12], b[12:16], b[16:20], b[20:])
+}
+
+func (s *Server) HandleSBOM(w http.ResponseWriter, buildID string) {
+	b, ok := s.readProvenance(w, buildID)
+	if !ok {
+		return
+	}
+	var p Provenance
+	if err := json.Unmarshal(b, &p); err != nil {
+		log.Println("Error decoding provenance:", err)
+		http.Error(w, "error reading provenance", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.cyclonedx+json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(NewSBOM(&p)); err != nil {
+		log.Println("/sbom error:", err)
+	}
+}
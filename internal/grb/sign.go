@@ -0,0 +1,169 @@
+package grb
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Headers with which the server sends the signature of an artifact.
+const (
+	// MetadataHeader holds base64-encoded JSON ArtifactMetadata.
+	MetadataHeader = "X-Grb-Metadata"
+	// SignatureHeader holds the base64-encoded ed25519 signature of the
+	// artifact hash and metadata; see SignedMessage.
+	SignatureHeader = "X-Grb-Signature"
+)
+
+// ArtifactMetadata describes how an artifact was built.
+// The server signs it along with the artifact's hash.
+type ArtifactMetadata struct {
+	BuildID   string
+	Package   string
+	GOOS      string
+	GOARCH    string
+	Flags     []string
+	Toolchain string
+	Time      time.Time
+}
+
+// SignedMessage is the message that the server signs for an artifact with
+// the given hex SHA-256 hash and JSON-encoded metadata.
+func SignedMessage(hash string, metadata []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "grb artifact v1\n%s\n", hash)
+	buf.Write(metadata)
+	return buf.Bytes()
+}
+
+var ErrBadSignature = errors.New("artifact signature does not verify with the pinned public key")
+
+// VerifyArtifact checks the signature headers in h for an artifact with the
+// given hash against pub. If the signature is valid, it returns the signed
+// metadata.
+func VerifyArtifact(pub ed25519.PublicKey, hash string, h http.Header) (*ArtifactMetadata, error) {
+	metadata, err := base64.StdEncoding.DecodeString(h.Get(MetadataHeader))
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(h.Get(SignatureHeader))
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	if !ed25519.Verify(pub, SignedMessage(hash, metadata), sig) {
+		return nil, ErrBadSignature
+	}
+	var md ArtifactMetadata
+	if err := json.Unmarshal(metadata, &md); err != nil {
+		return nil, err
+	}
+	return &md, nil
+}
+
+// signArtifact sets the signature headers for the artifact a, built with the
+// given flags. It does nothing if the server has no signing key.
+func (s *Server) signArtifact(h http.Header, buildID string, a Artifact, flags []string) error {
+	if s.SigningKey == nil {
+		return nil
+	}
+	toolchain, err := s.toolchain()
+	if err != nil {
+		return err
+	}
+	metadata, err := json.Marshal(&ArtifactMetadata{
+		BuildID:   buildID,
+		Package:   a.Package,
+		GOOS:      a.GOOS,
+		GOARCH:    a.GOARCH,
+		Flags:     flags,
+		Toolchain: toolchain,
+		Time:      time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	sig := ed25519.Sign(s.SigningKey, SignedMessage(a.SHA256, metadata))
+	h.Set(MetadataHeader, base64.StdEncoding.EncodeToString(metadata))
+	h.Set(SignatureHeader, base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
+
+func (s *Server) HandlePublicKey(w http.ResponseWriter) {
+	if s.SigningKey == nil {
+		http.Error(w, "server does not sign artifacts", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, EncodePublicKey(s.SigningKey.Public().(ed25519.PublicKey)))
+}
+
+// EncodePublicKey encodes pub as base64, which is the form in which public
+// keys are given to the client.
+func EncodePublicKey(pub ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+// DecodePublicKey decodes a public key encoded by EncodePublicKey.
+func DecodePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("malformed public key (want a base64-encoded ed25519 key)")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// LoadSigningKey reads an ed25519 private key from a PEM-encoded PKCS #8
+// file, such as is written by GenerateSigningKey or by
+// openssl genpkey -algorithm ed25519.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM-encoded private key found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	return priv, nil
+}
+
+// GenerateSigningKey creates a new ed25519 private key and writes it to the
+// new file path.
+func GenerateSigningKey(path string) (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return priv, f.Close()
+}
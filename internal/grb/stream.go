@@ -0,0 +1,85 @@
+package grb
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// ExitStatusTrailer is the HTTP trailer with which the server sends the exit
+// status of a command whose output it streams to the client, such as
+// go test. A command killed by a signal has status 128 plus the signal
+// number, as in the shell.
+const ExitStatusTrailer = "X-Grb-Exit-Status"
+
+// An eventStream sends a stream of JSON events, one per line, to the client
+// as they're produced.
+type eventStream struct {
+	mu sync.Mutex
+	w  http.ResponseWriter
+}
+
+// write sends b, which holds complete lines.
+func (es *eventStream) write(b []byte) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.w.Write(b)
+	if f, ok := es.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (es *eventStream) writeEvent(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err) // can't happen
+	}
+	es.write(append(b, '\n'))
+}
+
+// setExitStatus sets the ExitStatusTrailer for cmd, which has finished.
+func setExitStatus(w http.ResponseWriter, cmd *exec.Cmd) {
+	w.Header().Set(ExitStatusTrailer, strconv.Itoa(exitStatus(cmd.ProcessState)))
+}
+
+// exitStatus returns the exit status of a process, or 128 plus the signal
+// number if it was killed by a signal.
+func exitStatus(ps *os.ProcessState) int {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ps.ExitCode()
+}
+
+// A lineWriter is an io.Writer that calls fn with each complete line
+// (including the newline) written to it.
+type lineWriter struct {
+	buf []byte
+	fn  func(line []byte)
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lw.fn(lw.buf[:i+1])
+		lw.buf = lw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush calls fn with any incomplete final line, adding a newline.
+func (lw *lineWriter) flush() {
+	if len(lw.buf) > 0 {
+		lw.fn(append(lw.buf, '\n'))
+		lw.buf = nil
+	}
+}
@@ -0,0 +1,347 @@
+package grb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// A TestEvent is an event in the output of go test -json.
+type TestEvent struct {
+	Time    time.Time
+	Action  string
+	Package string  `json:",omitempty"`
+	Test    string  `json:",omitempty"`
+	Elapsed float64 `json:",omitempty"`
+	Output  string  `json:",omitempty"`
+}
+
+type testFlagKind int
+
+const (
+	testFlagBool testFlagKind = iota
+	testFlagValue
+	testFlagOutput // the value names a file that go test writes
+)
+
+// testFlags lists the go test flags that clients may use. Files named by
+// output flags are written on the server and returned to the client as
+// artifacts. Other flags that write files on the server (or run other
+// programs) are not allowed.
+var testFlags = map[string]testFlagKind{
+	"bench":                testFlagValue,
+	"benchmem":             testFlagBool,
+	"benchtime":            testFlagValue,
+	"blockprofile":         testFlagOutput,
+	"blockprofilerate":     testFlagValue,
+	"c":                    testFlagBool,
+	"count":                testFlagValue,
+	"cover":                testFlagBool,
+	"covermode":            testFlagValue,
+	"coverpkg":             testFlagValue,
+	"coverprofile":         testFlagOutput,
+	"cpu":                  testFlagValue,
+	"cpuprofile":           testFlagOutput,
+	"failfast":             testFlagBool,
+	"list":                 testFlagValue,
+	"memprofile":           testFlagOutput,
+	"memprofilerate":       testFlagValue,
+	"mutexprofile":         testFlagOutput,
+	"mutexprofilefraction": testFlagValue,
+	"parallel":             testFlagValue,
+	"run":                  testFlagValue,
+	"short":                testFlagBool,
+	"shuffle":              testFlagValue,
+	"skip":                 testFlagValue,
+	"timeout":              testFlagValue,
+	"trace":                testFlagOutput,
+	"v":                    testFlagBool,
+}
+
+type testFlag struct {
+	name     string
+	value    string
+	hasValue bool
+}
+
+// parseTestFlags parses flags, returning an error if it includes anything
+// but the allowed test flags and their values.
+func parseTestFlags(flags []string) ([]testFlag, error) {
+	var parsed []testFlag
+	for i := 0; i < len(flags); i++ {
+		flag := flags[i]
+		if !strings.HasPrefix(flag, "-") {
+			return nil, fmt.Errorf("unexpected argument %q in test flags", flag)
+		}
+		var f testFlag
+		f.name = strings.TrimPrefix(strings.TrimPrefix(flag, "-"), "-")
+		f.name = strings.TrimPrefix(f.name, "test.")
+		if j := strings.IndexByte(f.name, '='); j >= 0 {
+			f.name, f.value = f.name[:j], f.name[j+1:]
+			f.hasValue = true
+		}
+		kind, ok := testFlags[f.name]
+		if !ok {
+			return nil, fmt.Errorf("test flag %s is not allowed", flag)
+		}
+		if kind != testFlagBool && !f.hasValue {
+			i++
+			if i == len(flags) {
+				return nil, fmt.Errorf("test flag %s needs a value", flag)
+			}
+			f.value = flags[i]
+			f.hasValue = true
+		}
+		parsed = append(parsed, f)
+	}
+	return parsed, nil
+}
+
+func checkTestFlags(flags []string) error {
+	_, err := parseTestFlags(flags)
+	return err
+}
+
+// TestOutputs returns the names of the files that go test writes, other
+// than test binaries, when run with the given flags, keyed by the flags
+// that name them. These are also the names of the artifacts of a test run.
+func TestOutputs(flags []string) (map[string]string, error) {
+	parsed, err := parseTestFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+	outputs := make(map[string]string)
+	for _, f := range parsed {
+		if testFlags[f.name] == testFlagOutput {
+			outputs[f.name] = f.value
+		}
+	}
+	return outputs, nil
+}
+
+// testArgs returns flags as arguments for go test, with the files named by
+// output flags written to dir (each named after its flag) instead.
+func testArgs(flags []testFlag, dir string) []string {
+	var args []string
+	for _, f := range flags {
+		switch {
+		case testFlags[f.name] == testFlagOutput:
+			args = append(args, "-"+f.name+"="+filepath.Join(dir, f.name))
+		case f.hasValue:
+			args = append(args, "-"+f.name+"="+f.value)
+		default:
+			args = append(args, "-"+f.name)
+		}
+	}
+	return args
+}
+
+// HandleTest runs go test -json on the packages of a build and streams the
+// test events to the client. Output that go test writes to stderr, such as
+// compile errors, is sent as output events. Once go test finishes, its exit
+// status is sent in the ExitStatusTrailer trailer.
+//
+// The test binaries run in sandboxes, each in its package's directory in a
+// copy of the build's GOPATH, with a minimal environment. go test is killed
+// if it takes longer than TestTimeout or the client goes away.
+//
+// The files that go test writes (profiles and test binaries) are kept, like
+// the artifacts of a build of several packages, and listed in the
+// provenance of the build.
+func (s *Server) HandleTest(w http.ResponseWriter, r *http.Request, buildID string) {
+	if s.TestTimeout == 0 || !sandboxSupported {
+		http.Error(w, "this server doesn't run tests", http.StatusForbidden)
+		return
+	}
+	breq, ok := s.lookupBuild(w, buildID)
+	if !ok {
+		return
+	}
+	flags, err := parseTestFlags(breq.TestFlags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	started := time.Now()
+	root, err := s.newRoot(buildID)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	defer os.RemoveAll(root)
+	// Tests read their testdata at run time, so they need a real GOPATH
+	// even if the server builds using overlays. Since tests may write to
+	// their files, those must not be hard links into the cache.
+	mode := s.LinkMode
+	if mode < LinkReflink {
+		mode = LinkReflink
+	}
+	if err := s.buildGOPATH(breq, root, mode); err != nil {
+		writeBuildError(w, fmt.Errorf("error building GOPATH: %s", err))
+		return
+	}
+	outDir := filepath.Join(root, "testout")
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	// go test builds the test binaries in a temporary directory, which
+	// must be visible in the sandboxes.
+	tmpDir := filepath.Join(root, "tmp")
+	if err := os.Mkdir(tmpDir, 0755); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	execFlag, err := sandboxTestExec(filepath.Join(s.DataDir, sandboxDir), root)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	gocache, err := s.gocache()
+	if err != nil {
+		writeBuildError(w, fmt.Errorf("error creating GOCACHE: %s", err))
+		return
+	}
+
+	args := []string{"test", "-json", "-exec", execFlag}
+	args = append(args, breq.Flags...)
+	args = append(args, breq.packageNames()...)
+	args = append(args, testArgs(flags, outDir)...)
+	cmd := s.goCmd(args...)
+	cmd.Dir = root
+	cmd.Env = append(cmd.Env, goEnv(root, gocache)...)
+	cmd.Env = append(cmd.Env, "GOTMPDIR="+tmpDir)
+	cmd.Env = append(cmd.Env, breq.environ()...)
+	newProcessGroup(cmd)
+	es := &eventStream{w: w}
+	stdout := &lineWriter{fn: es.write}
+	stderr := &lineWriter{fn: func(line []byte) {
+		es.writeEvent(&TestEvent{
+			Time:   time.Now(),
+			Action: "output",
+			Output: string(line),
+		})
+	}}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Trailer", ExitStatusTrailer)
+	s.gocacheMu.RLock()
+	err = cmd.Start()
+	if err == nil {
+		err = waitLimited(r.Context(), cmd, s.TestTimeout, func() {
+			msg := fmt.Sprintf("grb: killed after the time limit of %s\n", s.TestTimeout)
+			es.writeEvent(&TestEvent{Time: time.Now(), Action: "output", Output: msg})
+		})
+	}
+	s.gocacheMu.RUnlock()
+	s.maybeTrimGOCACHE()
+	stdout.flush()
+	stderr.flush()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			// Without the trailer, the client knows that the tests
+			// didn't run to completion.
+			log.Println("Error running go test:", err)
+			return
+		}
+	}
+	artifacts, err := s.storeTestOutputs(buildID, breq, root, outDir)
+	if err != nil {
+		log.Println("Error storing test outputs:", err)
+		return
+	}
+	if len(artifacts) > 0 {
+		if err := s.writeProvenance(buildID, breq, started, artifacts); err != nil {
+			log.Println("Error writing provenance:", err)
+			return
+		}
+	}
+	setExitStatus(w, cmd)
+}
+
+// storeTestOutputs moves the files written by go test for breq, the outputs
+// in outDir and any test binaries in root, to the artifacts directory.
+func (s *Server) storeTestOutputs(buildID string, breq *BuildRequest, root, outDir string) ([]Artifact, error) {
+	var srcs []string
+	for _, pattern := range []string{
+		filepath.Join(outDir, "*"),
+		filepath.Join(root, "*.test"),
+		filepath.Join(root, "*.test.exe"),
+	} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		srcs = append(srcs, matches...)
+	}
+	if len(srcs) == 0 {
+		return nil, nil
+	}
+	dir, err := s.newArtifactsDir(buildID)
+	if err != nil {
+		return nil, err
+	}
+	// Profiles are attributed to the tested package, if there's just one.
+	profilePkg := breq.PackageName
+	if len(breq.PackageNames) == 1 {
+		profilePkg = breq.PackageNames[0]
+	}
+	var artifacts []Artifact
+	for _, src := range srcs {
+		name := filepath.Base(src)
+		pkg := profilePkg
+		if filepath.Dir(src) == outDir {
+			if name == "coverprofile" {
+				if err := rewriteCoverProfile(src, filepath.Join(root, "src")); err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			// A test binary, named after the last element of its
+			// package's import path.
+			base := strings.TrimSuffix(strings.TrimSuffix(name, ".exe"), ".test")
+			for _, p := range breq.packageNames() {
+				if path.Base(p) == base {
+					pkg = p
+				}
+			}
+		}
+		a, err := storeArtifact(src, filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		a.Name = name
+		a.Package = pkg
+		a.GOOS = runtime.GOOS
+		a.GOARCH = runtime.GOARCH
+		artifacts = append(artifacts, a)
+	}
+	return artifacts, nil
+}
+
+// rewriteCoverProfile rewrites the coverage profile at name so that any
+// files under src, the GOPATH's source directory, are named by import path.
+func rewriteCoverProfile(name, src string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	prefix := src + string(filepath.Separator)
+	lines := strings.SplitAfter(string(b), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			lines[i] = filepath.ToSlash(strings.TrimPrefix(line, prefix))
+		}
+	}
+	return ioutil.WriteFile(name, []byte(strings.Join(lines, "")), 0644)
+}
@@ -0,0 +1,71 @@
+package grb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckTestFlags(t *testing.T) {
+	for _, tt := range []struct {
+		flags []string
+		ok    bool
+	}{
+		{nil, true},
+		{[]string{"-v", "-run", "Foo", "-count=1"}, true},
+		{[]string{"-test.run=Foo", "--short", "-bench", "."}, true},
+		{[]string{"-run"}, false},
+		{[]string{"-exec", "sh"}, false},
+		{[]string{"-coverprofile=c.out", "-c"}, true},
+		{[]string{"-o", "x.test"}, false},
+		{[]string{"-test.outputdir", "/tmp"}, false},
+		{[]string{"-v", "extra"}, false},
+	} {
+		err := checkTestFlags(tt.flags)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkTestFlags(%q): got err=%v; want ok=%t", tt.flags, err, tt.ok)
+		}
+	}
+}
+
+func TestTestArgs(t *testing.T) {
+	flags := []string{"-v", "--run", "Foo", "-test.coverprofile=c.out", "-cpuprofile", "/tmp/cpu.out", "-count=2"}
+	parsed, err := parseTestFlags(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := testArgs(parsed, "/out")
+	want := []string{"-v", "-run=Foo", "-coverprofile=/out/coverprofile", "-cpuprofile=/out/cpuprofile", "-count=2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("testArgs: got %q; want %q", got, want)
+	}
+	outputs, err := TestOutputs(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantOutputs := map[string]string{"coverprofile": "c.out", "cpuprofile": "/tmp/cpu.out"}
+	if !reflect.DeepEqual(outputs, wantOutputs) {
+		t.Errorf("TestOutputs: got %v; want %v", outputs, wantOutputs)
+	}
+}
+
+func TestValidFileName(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		ok   bool
+	}{
+		{"a.go", true},
+		{"testdata/x/y.txt", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../a.go", false},
+		{"/etc/passwd", false},
+		{"testdata/../../a.go", false},
+		{"testdata//a", false},
+		{`a\b.go`, false},
+	} {
+		if got := validFileName(tt.name); got != tt.ok {
+			t.Errorf("validFileName(%q) = %t; want %t", tt.name, got, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package grb
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// A BinarySummary describes a built executable well enough to tell whether,
+// and where, two builds differ.
+type BinarySummary struct {
+	Size     int64
+	SHA256   string
+	Sections []Section // empty if the executable format isn't recognized
+}
+
+// A Section summarizes one section of an executable.
+type Section struct {
+	Name   string
+	Size   int64
+	SHA256 string // empty for sections with no data in the file (like .bss)
+}
+
+// SummarizeBinary summarizes the ELF, Mach-O, or PE executable at path.
+func SummarizeBinary(path string) (*BinarySummary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	sum := &BinarySummary{
+		Size:   n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}
+	sum.Sections, err = binarySections(f)
+	if err != nil {
+		return nil, err
+	}
+	return sum, nil
+}
+
+func binarySections(r io.ReaderAt) ([]Section, error) {
+	var sections []Section
+	if f, err := elf.NewFile(r); err == nil {
+		for _, s := range f.Sections {
+			if s.Name == "" {
+				continue
+			}
+			sec := Section{Name: s.Name, Size: int64(s.Size)}
+			if s.Type != elf.SHT_NOBITS {
+				if sec.SHA256, err = hashReader(s.Open()); err != nil {
+					return nil, err
+				}
+			}
+			sections = append(sections, sec)
+		}
+		return sections, nil
+	}
+	if f, err := macho.NewFile(r); err == nil {
+		for _, s := range f.Sections {
+			sec := Section{Name: s.Seg + "," + s.Name, Size: int64(s.Size)}
+			if s.Offset != 0 {
+				if sec.SHA256, err = hashReader(s.Open()); err != nil {
+					return nil, err
+				}
+			}
+			sections = append(sections, sec)
+		}
+		return sections, nil
+	}
+	if f, err := pe.NewFile(r); err == nil {
+		for _, s := range f.Sections {
+			sec := Section{Name: s.Name, Size: int64(s.Size)}
+			if sec.SHA256, err = hashReader(s.Open()); err != nil {
+				return nil, err
+			}
+			sections = append(sections, sec)
+		}
+		return sections, nil
+	}
+	return nil, nil
+}
+
+func hashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DiffBinaries describes the differences between two summarized binaries,
+// one line per differing section. It returns nil if they are identical.
+func DiffBinaries(a, b *BinarySummary) []string {
+	if a.SHA256 == b.SHA256 {
+		return nil
+	}
+	diffs := []string{fmt.Sprintf("file: %d bytes (sha256 %.12s) vs. %d bytes (sha256 %.12s)",
+		a.Size, a.SHA256, b.Size, b.SHA256)}
+	as := make(map[string]Section)
+	for _, s := range a.Sections {
+		as[s.Name] = s
+	}
+	bs := make(map[string]Section)
+	for _, s := range b.Sections {
+		bs[s.Name] = s
+	}
+	var names []string
+	for _, s := range a.Sections {
+		names = append(names, s.Name)
+	}
+	for _, s := range b.Sections {
+		if _, ok := as[s.Name]; !ok {
+			names = append(names, s.Name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sa, inA := as[name]
+		sb, inB := bs[name]
+		switch {
+		case !inB:
+			diffs = append(diffs, fmt.Sprintf("%s: only in first build", name))
+		case !inA:
+			diffs = append(diffs, fmt.Sprintf("%s: only in second build", name))
+		case sa.Size != sb.Size:
+			diffs = append(diffs, fmt.Sprintf("%s: %d bytes vs. %d bytes", name, sa.Size, sb.Size))
+		case sa.SHA256 != sb.SHA256:
+			diffs = append(diffs, fmt.Sprintf("%s: contents differ (%d bytes)", name, sa.Size))
+		}
+	}
+	return diffs
+}
+
+// A VerifyResult is the result of building a BuildRequest twice to check
+// whether the build is reproducible.
+type VerifyResult struct {
+	// Builds summarizes the two binaries. The first is built as usual;
+	// the second is built from scratch in a different root, without using
+	// the server's build cache.
+	Builds [2]*BinarySummary
+}
+
+func (s *Server) HandleVerify(w http.ResponseWriter, buildID string) {
+	breq, ok := s.lookupBuild(w, buildID)
+	if !ok {
+		return
+	}
+	if breq.manifest() {
+		http.Error(w, "can only verify a build of a single package for the server's platform", http.StatusBadRequest)
+		return
+	}
+	// Without -trimpath, each build records the directory it was built in,
+	// so the builds can't be identical.
+	if !boolFlagSet(breq.Flags, "trimpath") {
+		http.Error(w, "can only verify a build with -trimpath", http.StatusBadRequest)
+		return
+	}
+
+	var result VerifyResult
+	for i, fresh := range []bool{false, true} {
+		root, bin, err := s.compile(buildID, breq, fresh)
+		if err == nil {
+			result.Builds[i], err = SummarizeBinary(bin)
+		}
+		os.RemoveAll(root)
+		if err != nil {
+			writeBuildError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&result); err != nil {
+		log.Println("/verify error:", err)
+	}
+}
@@ -0,0 +1,54 @@
+package grb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffBinaries(t *testing.T) {
+	// The test binary itself is a handy executable.
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := SummarizeBinary(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Sections) == 0 {
+		t.Fatal("no sections found in test binary")
+	}
+	if diffs := DiffBinaries(a, a); diffs != nil {
+		t.Fatalf("binary differs from itself: %q", diffs)
+	}
+
+	// Flip a byte in the middle of the first section with data.
+	b, err := ioutil.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "grb-verify-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	modified := filepath.Join(dir, "modified")
+	b[len(b)/2] ^= 0xff
+	if err := ioutil.WriteFile(modified, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := SummarizeBinary(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs := DiffBinaries(a, b2)
+	if len(diffs) != 2 {
+		t.Fatalf("got diffs %q; want a file diff and one section diff", diffs)
+	}
+	if !strings.HasPrefix(diffs[0], "file: ") || !strings.Contains(diffs[1], "contents differ") {
+		t.Fatalf("unexpected diffs: %q", diffs)
+	}
+}
@@ -0,0 +1,238 @@
+package grb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A VetResult holds the findings of go vet, and of any extra analyzers, for
+// the packages of a build.
+type VetResult struct {
+	Diagnostics []Diagnostic
+	// Output is any other output of go vet, such as errors about packages
+	// that couldn't be loaded.
+	Output string `json:",omitempty"`
+}
+
+// A Diagnostic is a problem found by go vet or an analyzer, or an error
+// (such as a type error) that stopped a package from being checked.
+type Diagnostic struct {
+	// Package and File name the file as in the BuildRequest. If the file
+	// isn't one of the build's (for instance, it's in GOROOT), Package is
+	// empty and File is its path on the server.
+	Package   string `json:",omitempty"`
+	File      string
+	LocalPath string `json:",omitempty"` // only used by client
+	Line      int
+	Column    int
+	Analyzer  string `json:",omitempty"` // empty for errors
+	Message   string
+}
+
+func (d *Diagnostic) String() string {
+	path := d.LocalPath
+	if path == "" {
+		path = d.File
+		if d.Package != "" {
+			path = d.Package + "/" + d.File
+		}
+	}
+	s := fmt.Sprintf("%s:%d:%d: %s", path, d.Line, d.Column, d.Message)
+	if d.Analyzer != "" {
+		s += " (" + d.Analyzer + ")"
+	}
+	return s
+}
+
+// HandleVet runs go vet, and the analyzers named in the build's Analyzers,
+// on the packages of a build and sends the client a VetResult.
+func (s *Server) HandleVet(w http.ResponseWriter, buildID string) {
+	breq, ok := s.lookupBuild(w, buildID)
+	if !ok {
+		return
+	}
+	if len(breq.Targets) > 0 {
+		http.Error(w, "can only vet packages for the server's platform", http.StatusBadRequest)
+		return
+	}
+	root, overlay, err := s.prepareBuild(buildID, breq)
+	defer os.RemoveAll(root)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	gocache, err := s.gocache()
+	if err != nil {
+		writeBuildError(w, fmt.Errorf("error creating GOCACHE: %s", err))
+		return
+	}
+	vr := &vetRun{
+		root:  root,
+		files: make(map[string][2]string),
+	}
+	for _, pkg := range breq.Packages {
+		for _, file := range pkg.Files {
+			vr.files[filepath.Join(root, "src", pkg.Name, file.Name)] = [2]string{pkg.Name, file.Name}
+		}
+	}
+	tools := append([]string{""}, breq.Analyzers...)
+	for _, tool := range tools {
+		args := []string{"vet", "-json"}
+		if tool != "" {
+			args = append(args, "-vettool="+s.Analyzers[tool])
+		}
+		if overlay != "" {
+			args = append(args, "-overlay", overlay)
+		}
+		args = append(args, breq.Flags...)
+		args = append(args, breq.packageNames()...)
+		cmd := s.goCmd(args...)
+		cmd.Dir = root
+		cmd.Env = append(cmd.Env, goEnv(root, gocache)...)
+		cmd.Env = append(cmd.Env, breq.environ()...)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		s.gocacheMu.RLock()
+		err := cmd.Run()
+		s.gocacheMu.RUnlock()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			log.Println("Error running go vet:", err)
+			http.Error(w, "error running go vet", http.StatusInternalServerError)
+			return
+		}
+		// Depending on the Go version, the JSON is written to stdout or
+		// stderr, along with any errors.
+		vr.parse(append(stdout.Bytes(), stderr.Bytes()...))
+	}
+	s.maybeTrimGOCACHE()
+	sort.SliceStable(vr.result.Diagnostics, func(i, j int) bool {
+		di, dj := vr.result.Diagnostics[i], vr.result.Diagnostics[j]
+		if di.Package != dj.Package {
+			return di.Package < dj.Package
+		}
+		if di.File != dj.File {
+			return di.File < dj.File
+		}
+		if di.Line != dj.Line {
+			return di.Line < dj.Line
+		}
+		return di.Column < dj.Column
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&vr.result); err != nil {
+		log.Println("/vet error:", err)
+	}
+}
+
+// A vetRun collects the output of go vet in a GOPATH.
+type vetRun struct {
+	root   string
+	files  map[string][2]string // path on the server -> package and file name
+	result VetResult
+}
+
+// vetErrorRE matches errors from go vet, such as
+// "vet: src/p/p.go:3:23: undefined: x".
+var vetErrorRE = regexp.MustCompile(`^(?:vet: )?(.+\.go:\d+:\d+): (.*)$`)
+
+// parse parses the output of go vet -json: JSON objects, mapping package IDs
+// to analyzers to diagnostics, interspersed with other lines.
+func (vr *vetRun) parse(b []byte) {
+	var output []string
+	for len(b) > 0 {
+		if b[0] == '{' {
+			var pkgs map[string]map[string]json.RawMessage
+			dec := json.NewDecoder(bytes.NewReader(b))
+			if err := dec.Decode(&pkgs); err == nil {
+				vr.addJSON(pkgs)
+				b = b[dec.InputOffset():]
+				b = bytes.TrimLeft(b, "\n")
+				continue
+			}
+		}
+		line := b
+		b = nil
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line, b = line[:i], line[i+1:]
+		}
+		if m := vetErrorRE.FindSubmatch(line); m != nil {
+			if d, ok := vr.diagnostic(string(m[1])); ok {
+				d.Message = string(m[2])
+				vr.result.Diagnostics = append(vr.result.Diagnostics, d)
+				continue
+			}
+		}
+		if len(line) == 0 || bytes.HasPrefix(line, []byte("# ")) {
+			// Blank lines and package headers.
+			continue
+		}
+		output = append(output, string(line)+"\n")
+	}
+	vr.result.Output += strings.Join(output, "")
+}
+
+func (vr *vetRun) addJSON(pkgs map[string]map[string]json.RawMessage) {
+	for _, analyzers := range pkgs {
+		for analyzer, raw := range analyzers {
+			var diags []struct {
+				Posn    string `json:"posn"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal(raw, &diags); err != nil {
+				// An analyzer error, reported as {"error": "..."}.
+				var e struct {
+					Error string `json:"error"`
+				}
+				json.Unmarshal(raw, &e)
+				vr.result.Output += fmt.Sprintf("%s: %s\n", analyzer, e.Error)
+				continue
+			}
+			for _, diag := range diags {
+				d, ok := vr.diagnostic(diag.Posn)
+				if !ok {
+					continue
+				}
+				d.Analyzer = analyzer
+				d.Message = diag.Message
+				vr.result.Diagnostics = append(vr.result.Diagnostics, d)
+			}
+		}
+	}
+}
+
+// diagnostic returns a Diagnostic for the position posn (file:line:col).
+func (vr *vetRun) diagnostic(posn string) (Diagnostic, bool) {
+	i := strings.LastIndexByte(posn, ':')
+	if i < 0 {
+		return Diagnostic{}, false
+	}
+	j := strings.LastIndexByte(posn[:i], ':')
+	if j < 0 {
+		return Diagnostic{}, false
+	}
+	line, err1 := strconv.Atoi(posn[j+1 : i])
+	col, err2 := strconv.Atoi(posn[i+1:])
+	if err1 != nil || err2 != nil {
+		return Diagnostic{}, false
+	}
+	d := Diagnostic{File: posn[:j], Line: line, Column: col}
+	path := d.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(vr.root, path)
+	}
+	if f, ok := vr.files[path]; ok {
+		d.Package, d.File = f[0], f[1]
+	}
+	return d, true
+}
@@ -0,0 +1,57 @@
+package grb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVetParse(t *testing.T) {
+	vr := &vetRun{
+		root: "/data/gopath/x",
+		files: map[string][2]string{
+			"/data/gopath/x/src/p/p.go":      {"p", "p.go"},
+			"/data/gopath/x/src/p/p_test.go": {"p", "p_test.go"},
+			"/data/gopath/x/src/q/q.go":      {"q", "q.go"},
+		},
+	}
+	vr.parse([]byte(`# p
+{
+	"p": {
+		"printf": [
+			{
+				"posn": "/data/gopath/x/src/p/p.go:6:14",
+				"end": "/data/gopath/x/src/p/p.go:6:16",
+				"message": "bad format"
+			}
+		]
+	}
+}
+{
+	"p [p.test]": {
+		"copylocks": [
+			{
+				"posn": "/data/gopath/x/src/p/p_test.go:3:1",
+				"message": "copies lock"
+			}
+		],
+		"custom": {
+			"error": "analysis failed"
+		}
+	}
+}
+# q
+vet: src/q/q.go:3:23: undefined: x
+something else
+`))
+	want := VetResult{
+		Diagnostics: []Diagnostic{
+			{Package: "p", File: "p.go", Line: 6, Column: 14, Analyzer: "printf", Message: "bad format"},
+			{Package: "p", File: "p_test.go", Line: 3, Column: 1, Analyzer: "copylocks", Message: "copies lock"},
+			{Package: "q", File: "q.go", Line: 3, Column: 23, Message: "undefined: x"},
+		},
+		Output: "custom: analysis failed\nsomething else\n",
+	}
+	if !reflect.DeepEqual(vr.result, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", vr.result, want)
+	}
+}
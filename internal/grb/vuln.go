@@ -0,0 +1,307 @@
+package grb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A VulnDB is a snapshot of the Go vulnerability database
+// (https://vuln.go.dev) loaded from disk. The directory layout is the same as
+// that of the database itself (and of its vulndb.zip): the OSV entries are
+// JSON files in the ID subdirectory.
+type VulnDB struct {
+	entries []*osvEntry
+}
+
+// osvEntry is the subset of the OSV format that the Go vulnerability
+// database uses which we need. See https://ossf.github.io/osv-schema/.
+type osvEntry struct {
+	ID        string `json:"id"`
+	Summary   string `json:"summary"`
+	Withdrawn string `json:"withdrawn"`
+	Affected  []struct {
+		Package struct {
+			Name      string `json:"name"`
+			Ecosystem string `json:"ecosystem"`
+		} `json:"package"`
+		Ranges []struct {
+			Type   string     `json:"type"`
+			Events []osvEvent `json:"events"`
+		} `json:"ranges"`
+		EcosystemSpecific struct {
+			Imports []osvImport `json:"imports"`
+		} `json:"ecosystem_specific"`
+	} `json:"affected"`
+}
+
+type osvEvent struct {
+	Introduced string `json:"introduced"`
+	Fixed      string `json:"fixed"`
+}
+
+type osvImport struct {
+	Path string `json:"path"`
+}
+
+// LoadVulnDB loads the vulnerability database snapshot in dir.
+func LoadVulnDB(dir string) (*VulnDB, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "ID", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%s: no vulnerability entries found in ID/", dir)
+	}
+	db := new(VulnDB)
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var e osvEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		if e.Withdrawn == "" {
+			db.entries = append(db.entries, &e)
+		}
+	}
+	return db, nil
+}
+
+// A Vuln is a known vulnerability which affects a package in a build.
+type Vuln struct {
+	ID      string
+	Summary string
+	Package string // import path
+	Version string // the version of the package in the build, if known
+	Fixed   string // the version with a fix for Version, if any
+	// Unknown is set if the vulnerability affects only some versions of
+	// the package and Version isn't a semantic version (in GOPATH mode, it
+	// is often a commit hash), so it can't be told whether the package is
+	// affected.
+	Unknown bool
+}
+
+func (v Vuln) String() string {
+	s := v.ID + ": " + v.Package
+	if v.Version != "" {
+		s += "@" + v.Version
+	}
+	if v.Unknown {
+		s += " (unknown whether this version is affected)"
+	}
+	if v.Fixed != "" {
+		s += " (fixed in v" + v.Fixed + ")"
+	}
+	return s + ": " + v.Summary
+}
+
+// AnyAffected reports whether any of vulns is known to affect its package.
+func AnyAffected(vulns []Vuln) bool {
+	for _, v := range vulns {
+		if !v.Unknown {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns the vulnerabilities affecting packages, as well as those
+// that may affect packages whose versions aren't known (see Vuln.Unknown).
+// It does not consider the standard library, which isn't included in the
+// packages of a BuildRequest.
+func (db *VulnDB) Check(packages []*Package) []Vuln {
+	var vulns []Vuln
+	for _, pkg := range packages {
+		path := importPath(pkg.Name)
+		version := strings.TrimPrefix(pkg.Version, "v")
+		semver := isSemver(version)
+		for _, e := range db.entries {
+			for _, a := range e.Affected {
+				if a.Package.Ecosystem != "Go" || !affectsImport(a.Package.Name, a.EcosystemSpecific.Imports, path) {
+					continue
+				}
+				v := Vuln{
+					ID:      e.ID,
+					Summary: e.Summary,
+					Package: path,
+					Version: pkg.Version,
+				}
+				// With no ranges, every version is affected.
+				affected := len(a.Ranges) == 0
+				for _, r := range a.Ranges {
+					if r.Type != "SEMVER" {
+						continue
+					}
+					if affectsAll(r.Events) {
+						affected = true
+						continue
+					}
+					if !semver {
+						v.Unknown = true
+						continue
+					}
+					introduced := ""
+					for _, ev := range r.Events {
+						if ev.Introduced != "" {
+							introduced = ev.Introduced
+						}
+						if ev.Fixed != "" {
+							if introduced != "" && inRange(version, introduced, ev.Fixed) {
+								affected = true
+								v.Fixed = ev.Fixed
+							}
+							introduced = ""
+						}
+					}
+					if introduced != "" && inRange(version, introduced, "") {
+						affected = true
+					}
+				}
+				if affected {
+					v.Unknown = false
+				}
+				if affected || v.Unknown {
+					vulns = append(vulns, v)
+				}
+			}
+		}
+	}
+	return vulns
+}
+
+// affectsAll reports whether the events of a range say that every version
+// is affected: it was introduced at the start and has never been fixed.
+// Such a range applies even when the version isn't known.
+func affectsAll(events []osvEvent) bool {
+	all := false
+	for _, ev := range events {
+		if ev.Fixed != "" {
+			return false
+		}
+		if ev.Introduced == "0" {
+			all = true
+		}
+	}
+	return all
+}
+
+// affectsImport reports whether a vulnerability in the given module, which
+// is limited to the given packages (if any are listed), affects the package
+// with the given import path.
+func affectsImport(module string, imports []osvImport, path string) bool {
+	if len(imports) > 0 {
+		for _, imp := range imports {
+			if imp.Path == path {
+				return true
+			}
+		}
+		return false
+	}
+	return path == module || strings.HasPrefix(path, module+"/")
+}
+
+// inRange reports whether version is in [introduced, fixed).
+// An empty fixed means that there's no upper bound.
+func inRange(version, introduced, fixed string) bool {
+	if introduced != "0" && compareSemver(version, introduced) < 0 {
+		return false
+	}
+	return fixed == "" || compareSemver(version, fixed) < 0
+}
+
+// isSemver reports whether v (without a leading "v") is a semantic version.
+func isSemver(v string) bool {
+	_, _, ok := parseSemver(v)
+	return ok
+}
+
+func parseSemver(v string) (nums [3]int, pre string, ok bool) {
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i] // build metadata doesn't count
+	}
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+		if pre == "" {
+			return nums, "", false
+		}
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return nums, "", false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nums, "", false
+		}
+		nums[i] = n
+	}
+	return nums, pre, true
+}
+
+// compareSemver compares two semantic versions (without leading "v"s),
+// returning -1, 0, or +1.
+func compareSemver(a, b string) int {
+	an, apre, _ := parseSemver(a)
+	bn, bpre, _ := parseSemver(b)
+	for i := range an {
+		if an[i] != bn[i] {
+			return cmpInt(an[i], bn[i])
+		}
+	}
+	switch {
+	case apre == bpre:
+		return 0
+	case apre == "":
+		return 1
+	case bpre == "":
+		return -1
+	}
+	aids := strings.Split(apre, ".")
+	bids := strings.Split(bpre, ".")
+	for i := 0; i < len(aids) && i < len(bids); i++ {
+		if aids[i] == bids[i] {
+			continue
+		}
+		an, aerr := strconv.Atoi(aids[i])
+		bn, berr := strconv.Atoi(bids[i])
+		switch {
+		case aerr == nil && berr == nil:
+			return cmpInt(an, bn)
+		case aerr == nil:
+			return -1 // numeric identifiers sort first
+		case berr == nil:
+			return 1
+		case aids[i] < bids[i]:
+			return -1
+		default:
+			return 1
+		}
+	}
+	return cmpInt(len(aids), len(bids))
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// VulnReport formats vulns for display, one per line.
+func VulnReport(vulns []Vuln) string {
+	var b strings.Builder
+	for _, v := range vulns {
+		fmt.Fprintln(&b, v)
+	}
+	return b.String()
+}
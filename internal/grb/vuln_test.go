@@ -0,0 +1,109 @@
+package grb
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVulnDBCheck(t *testing.T) {
+	var entries []*osvEntry
+	if err := json.Unmarshal([]byte(`[
+		{
+			"id": "GO-2099-0001",
+			"summary": "vulnerable module",
+			"affected": [{
+				"package": {"name": "example.com/m", "ecosystem": "Go"},
+				"ranges": [{"type": "SEMVER", "events": [
+					{"introduced": "0"}, {"fixed": "1.2.0"},
+					{"introduced": "1.3.0"}, {"fixed": "1.3.2"}
+				]}]
+			}]
+		},
+		{
+			"id": "GO-2099-0002",
+			"summary": "vulnerable package",
+			"affected": [{
+				"package": {"name": "example.com/n", "ecosystem": "Go"},
+				"ranges": [{"type": "SEMVER", "events": [{"introduced": "2.0.0-rc.1"}]}],
+				"ecosystem_specific": {"imports": [{"path": "example.com/n/bad"}]}
+			}]
+		},
+		{
+			"id": "GO-2099-0003",
+			"summary": "every version is vulnerable",
+			"affected": [{"package": {"name": "example.com/o", "ecosystem": "Go"}}]
+		},
+		{
+			"id": "GO-2099-0004",
+			"summary": "unfixed",
+			"affected": [{
+				"package": {"name": "example.com/p", "ecosystem": "Go"},
+				"ranges": [{"type": "SEMVER", "events": [{"introduced": "0"}]}]
+			}]
+		}
+	]`), &entries); err != nil {
+		t.Fatal(err)
+	}
+	db := &VulnDB{entries: entries}
+
+	for _, tt := range []struct {
+		name    string
+		version string
+		want    string // ID of the expected vuln, if any
+		fixed   string
+		unknown bool
+	}{
+		{"example.com/m", "v1.1.9", "GO-2099-0001", "1.2.0", false},
+		{"example.com/m/sub", "v1.1.9", "GO-2099-0001", "1.2.0", false},
+		{"example.com/m", "v1.2.0", "", "", false},
+		{"example.com/m", "v1.3.1", "GO-2099-0001", "1.3.2", false},
+		{"example.com/m", "v1.3.2", "", "", false},
+		{"example.com/m", "", "GO-2099-0001", "", true},
+		{"example.com/m", "0123456789abcdef0123456789abcdef01234567", "GO-2099-0001", "", true},
+		{"x/vendor/example.com/m", "v1.0.0", "GO-2099-0001", "1.2.0", false},
+		{"example.com/mm", "v1.0.0", "", "", false},
+		{"example.com/n/bad", "v2.0.0-beta", "", "", false},
+		{"example.com/n/bad", "v2.0.0-rc.2", "GO-2099-0002", "", false},
+		{"example.com/n/bad", "v2.1.0", "GO-2099-0002", "", false},
+		{"example.com/n/good", "v2.1.0", "", "", false},
+		{"example.com/o", "", "GO-2099-0003", "", false},
+		{"example.com/p", "v1.0.0", "GO-2099-0004", "", false},
+		{"example.com/p", "0123456789abcdef0123456789abcdef01234567", "GO-2099-0004", "", false},
+	} {
+		vulns := db.Check([]*Package{{Name: tt.name, Version: tt.version}})
+		var got string
+		if len(vulns) > 1 {
+			t.Errorf("%s@%s: got %d vulns; want at most 1", tt.name, tt.version, len(vulns))
+			continue
+		}
+		if len(vulns) == 1 {
+			got = vulns[0].ID
+		}
+		if got != tt.want {
+			t.Errorf("%s@%s: got vuln %q; want %q", tt.name, tt.version, got, tt.want)
+			continue
+		}
+		if got == "" {
+			continue
+		}
+		if v := vulns[0]; v.Fixed != tt.fixed || v.Unknown != tt.unknown {
+			t.Errorf("%s@%s: got Fixed=%q, Unknown=%t; want Fixed=%q, Unknown=%t",
+				tt.name, tt.version, v.Fixed, v.Unknown, tt.fixed, tt.unknown)
+		}
+	}
+}
+
+func TestCompareSemver(t *testing.T) {
+	// In increasing order.
+	versions := []string{
+		"0.9.0", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.10.0", "2.0.0",
+	}
+	for i, a := range versions {
+		for j, b := range versions {
+			if got, want := compareSemver(a, b), cmpInt(i, j); got != want {
+				t.Errorf("compareSemver(%q, %q) = %d; want %d", a, b, got, want)
+			}
+		}
+	}
+}
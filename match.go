@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// matchPackages expands the packages given on the command line into import
+// paths. Relative packages are resolved against dir (or the current
+// directory). As with the go command, "..." in a pattern matches any string,
+// and a pattern ending in "/..." also matches the directory itself. If cmds
+// is set, since the point is to build binaries, only commands are kept.
+func matchPackages(patterns []string, dir, gopath string, cmds bool) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	bins := make(map[string]string)
+	add := func(name string) error {
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		if !cmds {
+			names = append(names, name)
+			return nil
+		}
+		bin := path.Base(name)
+		if other, ok := bins[bin]; ok {
+			return fmt.Errorf("%s and %s would both be written to %s", other, name, bin)
+		}
+		bins[bin] = name
+		names = append(names, name)
+		return nil
+	}
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "/") || strings.HasPrefix(pattern, ".") {
+			var err error
+			pattern, err = resolvePackage(dir, pattern, gopath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !strings.Contains(pattern, "...") {
+			if err := add(pattern); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		matches, err := matchPattern(pattern, gopath, cmds)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			if cmds {
+				return nil, fmt.Errorf("no commands match %s", pattern)
+			}
+			return nil, fmt.Errorf("no packages match %s", pattern)
+		}
+		for _, name := range matches {
+			if err := add(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return names, nil
+}
+
+// matchPattern finds the packages (or, if cmds is set, only the commands) in
+// gopath whose import paths match pattern.
+func matchPattern(pattern, gopath string, cmds bool) ([]string, error) {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\.\.\.`, `.*`, -1)
+	if strings.HasSuffix(expr, `/.*`) {
+		expr = strings.TrimSuffix(expr, `/.*`) + `(/.*)?`
+	}
+	re := regexp.MustCompile("^" + expr + "$")
+	// Only the part of the tree before the first wildcard can match.
+	prefix := pattern[:strings.Index(pattern, "...")]
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		prefix = prefix[:i]
+	} else {
+		prefix = ""
+	}
+
+	ctx := build.Default
+	ctx.GOPATH = gopath
+	var names []string
+	for _, gp := range filepath.SplitList(gopath) {
+		src := filepath.Join(gp, "src")
+		root := filepath.Join(src, filepath.FromSlash(prefix))
+		if _, err := os.Stat(root); err != nil {
+			continue
+		}
+		err := filepath.Walk(root, func(dir string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				return nil
+			}
+			if dir != root {
+				// Like the go command, skip directories that can't hold
+				// packages and vendored code.
+				base := fi.Name()
+				if strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_") ||
+					base == "testdata" || base == "vendor" {
+					return filepath.SkipDir
+				}
+			}
+			rel, err := filepath.Rel(src, dir)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(rel)
+			if !re.MatchString(name) {
+				return nil
+			}
+			pkg, err := ctx.ImportDir(dir, 0)
+			if err != nil {
+				if _, ok := err.(*build.NoGoError); ok {
+					return nil
+				}
+				return err
+			}
+			if pkg.Name == "main" || !cmds {
+				names = append(names, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sumsName is the name of the checksums manifest written by grb release,
+// in the format of sha256sum.
+const sumsName = "SHA256SUMS"
+
+type releaseConfig struct {
+	grbConfig
+	outDir string   // where to write the archives
+	name   string   // the prefix of the archive names
+	files  []string // extra files to include in every archive
+}
+
+func releaseMain(args []string) {
+	var rc releaseConfig
+	fs := flag.NewFlagSet("release", flag.ExitOnError)
+	addBuildFlags(fs, &rc.grbConfig)
+	fs.StringVar(&rc.targets, "targets", "", "build for this comma-separated list of GOOS/GOARCH platforms (default the server's)")
+	fs.StringVar(&rc.outDir, "o", "dist", "write the archives to this directory")
+	fs.StringVar(&rc.name, "name", "", "name the archives NAME_GOOS_GOARCH (default the name of the first package)")
+	files := fs.String("files", "", "comma-separated list of extra files, such as LICENSE, to include in every archive")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage: grb release [flags] [packages]
+
+Release builds the packages for each target and writes an archive of the
+binaries for each target (a zip file for Windows; otherwise a gzipped tar
+file) along with a SHA256SUMS file listing their checksums.
+
+The flags are:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	rc.pkgs = fs.Args()
+	if *files != "" {
+		rc.files = strings.Split(*files, ",")
+	}
+	rc.serverURL = serverURL()
+
+	if err := runRelease(rc); err != nil {
+		log.Fatalln("Fatal error:", err)
+	}
+}
+
+func runRelease(rc releaseConfig) error {
+	if len(rc.pkgs) == 0 {
+		rc.pkgs = []string{"."}
+	}
+	if rc.name == "" {
+		rc.name = defaultReleaseName(rc.pkgs[0], rc.dir)
+	}
+	if rc.targets == "" {
+		env, err := fetchEnv(rc.serverURL, newHTTPClient())
+		if err != nil {
+			return err
+		}
+		rc.targets = env.GOOS + "/" + env.GOARCH
+	}
+	targets, err := parseTargets(rc.targets)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir("", "grb-release-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	c := rc.grbConfig
+	c.out = tmp
+	c.stdout = ioutil.Discard
+	if err := runGRB(c); err != nil {
+		return err
+	}
+	bins, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(rc.outDir, 0755); err != nil {
+		return err
+	}
+	sums := make(map[string]string) // archive name -> hash
+	for _, t := range targets {
+		name := rc.name + "_" + t.GOOS + "_" + t.GOARCH
+		var files []archiveFile
+		suffix := t.BinaryName("")
+		for _, bin := range bins {
+			if !strings.HasSuffix(bin.Name(), suffix) {
+				continue
+			}
+			binName := strings.TrimSuffix(bin.Name(), suffix)
+			if t.GOOS == "windows" {
+				binName += ".exe"
+			}
+			files = append(files, archiveFile{
+				name: path.Join(name, binName),
+				src:  filepath.Join(tmp, bin.Name()),
+				mode: 0755,
+			})
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("no binaries were built for %s", t)
+		}
+		for _, file := range rc.files {
+			files = append(files, archiveFile{
+				name: path.Join(name, filepath.Base(file)),
+				src:  file,
+				mode: 0644,
+			})
+		}
+		archive := name + ".tar.gz"
+		write := writeTarGz
+		if t.GOOS == "windows" {
+			archive = name + ".zip"
+			write = writeZip
+		}
+		if err := write(filepath.Join(rc.outDir, archive), files); err != nil {
+			return err
+		}
+		sum, err := sha256File(filepath.Join(rc.outDir, archive))
+		if err != nil {
+			return err
+		}
+		sums[archive] = sum
+	}
+	archives := make([]string, 0, len(sums))
+	for archive := range sums {
+		archives = append(archives, archive)
+	}
+	sort.Strings(archives)
+	var manifest bytes.Buffer
+	for _, archive := range archives {
+		fmt.Fprintf(&manifest, "%s  %s\n", sums[archive], archive)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rc.outDir, sumsName), manifest.Bytes(), 0644); err != nil {
+		return err
+	}
+	os.Stdout.Write(manifest.Bytes())
+	return nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// defaultReleaseName returns the name of the package pattern pkg, which may
+// be relative to dir (or the current directory).
+func defaultReleaseName(pkg, dir string) string {
+	pkg = strings.TrimSuffix(pkg, "...")
+	pkg = strings.TrimSuffix(pkg, "/")
+	if pkg == "" || strings.HasPrefix(pkg, ".") || strings.HasPrefix(pkg, "/") {
+		if dir != "" {
+			pkg = filepath.Join(dir, pkg)
+		}
+		if abs, err := filepath.Abs(pkg); err == nil {
+			pkg = abs
+		}
+		return filepath.Base(pkg)
+	}
+	return path.Base(pkg)
+}
+
+// An archiveFile is a file to be written to a release archive.
+type archiveFile struct {
+	name string // the name in the archive
+	src  string
+	mode os.FileMode
+}
+
+func writeTarGz(dest string, files []archiveFile) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		fi, err := os.Stat(file.src)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    file.name,
+			Mode:    int64(file.mode),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime().Truncate(time.Second),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := copyFileTo(tw, file.src); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func writeZip(dest string, files []archiveFile) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, file := range files {
+		fi, err := os.Stat(file.src)
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = file.name
+		hdr.Method = zip.Deflate
+		hdr.SetMode(file.mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if err := copyFileTo(w, file.src); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/cespare/grb/internal/grb"
+)
+
+func runMain(args []string) {
+	var c grbConfig
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	addBuildFlags(fs, &c)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage: grb run [flags] [package] [-- args]
+
+Run builds the package on the build server and runs the binary there with
+the given arguments, printing its output. The binary runs in a sandbox, with
+a time limit set by the server. grb run exits with the exit status of the
+binary.
+
+The flags are:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	c.pkg, c.runArgs = splitRunArgs(args, fs.Args())
+	c.run = true
+	c.serverURL = serverURL()
+
+	if err := runGRB(c); err != nil {
+		if e, ok := err.(*exitStatusError); ok {
+			os.Exit(e.status)
+		}
+		log.Fatalln("Fatal error:", err)
+	}
+}
+
+// splitRunArgs splits rest, the arguments of grb run after its flags, into
+// the package (by default, ".") and the arguments of the binary. args are
+// all the arguments of grb run: the flag package drops a "--" that ends the
+// flags, and then there's no package.
+func splitRunArgs(args, rest []string) (pkg string, runArgs []string) {
+	if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+		return ".", rest
+	}
+	pkg = "."
+	if len(rest) > 0 && rest[0] != "--" {
+		pkg, rest = rest[0], rest[1:]
+	}
+	if len(rest) > 0 && rest[0] == "--" {
+		rest = rest[1:]
+	}
+	return pkg, rest
+}
+
+// runRemote runs the binary of the build with the given ID on the server and
+// prints its output as it arrives.
+func runRemote(conf *BuildConfig, client *http.Client, id string) error {
+	url := conf.ServerURL + "/run/" + id
+	log.Println("GET", url)
+	resp, err := client.Get(url)
+	if err != nil {
+		log.Println("Error making GET request:", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 412 {
+		log.Println("Build error:")
+		io.Copy(os.Stderr, resp.Body)
+	}
+	if resp.StatusCode != 200 {
+		log.Println("Non-200 status code from /run:", resp.StatusCode)
+		return errStatusNot200
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var event grb.RunEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			log.Println("Could not decode output of /run:", err)
+			return err
+		}
+		switch event.Stream {
+		case "stdout":
+			conf.stdout().Write(event.Data)
+		case "stderr":
+			os.Stderr.Write(event.Data)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("Error reading output:", err)
+		return err
+	}
+	return remoteExitStatus(resp)
+}
+
+// remoteExitStatus returns the error, if any, for the exit status of a
+// command that the server sent in the trailer of resp. The body of resp
+// must have been read.
+func remoteExitStatus(resp *http.Response) error {
+	status := resp.Trailer.Get(grb.ExitStatusTrailer)
+	if status == "" {
+		return errNoExitStatus
+	}
+	n, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("bad exit status %q from server", status)
+	}
+	if n != 0 {
+		return &exitStatusError{n}
+	}
+	return nil
+}
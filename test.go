@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cespare/grb/internal/grb"
+)
+
+// An exitStatusError reports the nonzero exit status of a command run on the
+// server, such as go test.
+type exitStatusError struct {
+	status int
+}
+
+func (e *exitStatusError) Error() string {
+	return fmt.Sprintf("remote command exited with status %d", e.status)
+}
+
+func testMain(args []string) {
+	var c grbConfig
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	addBuildFlags(fs, &c)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage: grb test [flags] [packages] [test flags]
+
+Test runs the tests of the packages on the build server with go test and
+prints the results. The test flags (such as -run, -v, and -count) follow the
+packages and are passed to go test; -json prints the test events as JSON.
+grb test exits with the exit status of go test.
+
+The flags are:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	c.test = true
+	c.pkgs, c.testFlags = splitTestArgs(fs.Args())
+	if len(c.pkgs) == 0 {
+		c.pkgs = []string{"."}
+	}
+	for i, flag := range c.testFlags {
+		if flag == "-json" || flag == "--json" {
+			c.testJSON = true
+			c.testFlags = append(c.testFlags[:i:i], c.testFlags[i+1:]...)
+			break
+		}
+	}
+	c.serverURL = serverURL()
+
+	if err := runGRB(c); err != nil {
+		if e, ok := err.(*exitStatusError); ok {
+			os.Exit(e.status)
+		}
+		log.Fatalln("Fatal error:", err)
+	}
+}
+
+// splitTestArgs splits the arguments of grb test into the packages and the
+// test flags, which start with the first flag.
+func splitTestArgs(args []string) (pkgs, testFlags []string) {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			return args[:i], args[i:]
+		}
+	}
+	return args, nil
+}
+
+// runTests runs the tests of the build with the given ID on the server and
+// prints the output as it arrives. Then it downloads any files that go test
+// wrote; pkgs are the packages of the build.
+func runTests(conf *BuildConfig, client *http.Client, id string, pkgs []*grb.Package) error {
+	url := conf.ServerURL + "/test/" + id
+	log.Println("GET", url)
+	resp, err := client.Get(url)
+	if err != nil {
+		log.Println("Error making GET request:", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 412 {
+		log.Println("Build error:")
+		io.Copy(os.Stderr, resp.Body)
+	}
+	if resp.StatusCode != 200 {
+		log.Println("Non-200 status code from /test:", resp.StatusCode)
+		return errStatusNot200
+	}
+	out := conf.stdout()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var event grb.TestEvent
+		if conf.TestJSON || json.Unmarshal(line, &event) != nil {
+			fmt.Fprintf(out, "%s\n", line)
+			continue
+		}
+		if event.Action == "output" {
+			io.WriteString(out, event.Output)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("Error reading test output:", err)
+		return err
+	}
+	statusErr := remoteExitStatus(resp)
+	if statusErr == errNoExitStatus {
+		return statusErr
+	}
+	outputs, err := grb.TestOutputs(conf.TestFlags)
+	if err != nil {
+		return err
+	}
+	compileOnly := false
+	for _, flag := range conf.TestFlags {
+		if flag == "-c" || flag == "--c" {
+			compileOnly = true
+		}
+	}
+	if len(outputs) > 0 || compileOnly {
+		// Even if the tests failed, the profiles may be of use.
+		if err := downloadTestOutputs(conf, client, id, outputs, pkgs); err != nil {
+			return err
+		}
+	}
+	return statusErr
+}
+
+// downloadTestOutputs downloads the files that go test wrote on the server
+// for the build with the given ID. Each output in outputs (keyed by the
+// flag that names it) is written to the name given in the flag, and test
+// binaries are written to the directory conf.OutputName. Coverage profiles
+// are rewritten to refer to the local files in pkgs.
+func downloadTestOutputs(conf *BuildConfig, client *http.Client, id string, outputs map[string]string, pkgs []*grb.Package) error {
+	b, err := fetchBuildRecord(conf, client, "provenance", id)
+	if err != nil {
+		return err
+	}
+	var prov grb.Provenance
+	if err := json.Unmarshal(b, &prov); err != nil {
+		log.Println("Could not decode /provenance JSON:", err)
+		return err
+	}
+	for _, a := range prov.Artifacts {
+		if a.Package != "" && a.Package != conf.PkgName && !contains(conf.PkgNames, a.Package) {
+			log.Printf("Test outputs include %s for %s, which wasn't tested", a.Name, a.Package)
+			return errMetadataMismatch
+		}
+		path, isOutput := outputs[a.Name]
+		if !isOutput {
+			path = filepath.Join(conf.OutputName, filepath.Base(a.Name))
+		}
+		if _, err := fetchArtifact(conf, client, id, a, path); err != nil {
+			return err
+		}
+		if isOutput {
+			if err := os.Chmod(path, 0644); err != nil {
+				return err
+			}
+		}
+		if a.Name == "coverprofile" {
+			if err := localizeCoverProfile(path, pkgs); err != nil {
+				return err
+			}
+		}
+		log.Printf("Wrote %s (from %s)", path, a.Name)
+	}
+	return nil
+}
+
+// localizeCoverProfile rewrites the coverage profile at name, which refers to
+// files by import path, to refer instead to the local files in pkgs, so that
+// tools such as go tool cover can find them.
+func localizeCoverProfile(name string, pkgs []*grb.Package) error {
+	localPaths := make(map[string]string)
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			localPaths[pkg.Name+"/"+file.Name] = file.LocalPath
+		}
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	for i, line := range lines {
+		// Lines look like "pkg/file.go:1.2,3.4 1 0".
+		j := strings.LastIndexByte(line, ':')
+		if j < 0 {
+			continue
+		}
+		if local, ok := localPaths[line[:j]]; ok {
+			lines[i] = local + line[j:]
+		}
+	}
+	return ioutil.WriteFile(name, []byte(strings.Join(lines, "")), 0644)
+}
+
+func contains(ss []string, s string) bool {
+	for _, s1 := range ss {
+		if s1 == s {
+			return true
+		}
+	}
+	return false
+}
+
+var errNoExitStatus = errors.New("server did not report the exit status (the remote command may not have finished)")
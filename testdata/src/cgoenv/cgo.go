@@ -0,0 +1,16 @@
+//go:build cgo
+
+package main
+
+/*
+#ifndef ANSWER
+#define ANSWER 0
+#endif
+
+static int answer() { return ANSWER; }
+*/
+import "C"
+
+import "fmt"
+
+func mode() string { return fmt.Sprint("cgo ", C.answer()) }
@@ -0,0 +1,7 @@
+//go:build !cgo
+
+package main
+
+import "a"
+
+func mode() string { return "no cgo " + a.A }
@@ -0,0 +1,3 @@
+#include "../ccommon/common.h"
+
+int helper(void) { return COMMON + 1; }
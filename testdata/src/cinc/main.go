@@ -0,0 +1,16 @@
+package main
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../cinclude
+#include "../ccommon/common.h"
+#include <answer.h>
+
+int helper(void);
+*/
+import "C"
+
+import "fmt"
+
+func main() {
+	fmt.Println(C.COMMON, C.ANSWER, C.helper())
+}
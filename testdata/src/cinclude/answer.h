@@ -0,0 +1,3 @@
+#include "sub/forty.h"
+
+#define ANSWER (FORTY + 2)
@@ -0,0 +1 @@
+#define FORTY 40
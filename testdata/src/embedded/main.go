@@ -0,0 +1,32 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+//go:embed greeting.txt
+var greeting string
+
+//go:embed static
+var static embed.FS
+
+//go:embed all:hidden
+var hidden embed.FS
+
+func main() {
+	fmt.Println(strings.TrimSpace(greeting))
+	for _, fsys := range []embed.FS{static, hidden} {
+		fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				fmt.Println(path)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+
+	"multi/lib"
+)
+
+func main() {
+	fmt.Println("bar", lib.Name)
+}
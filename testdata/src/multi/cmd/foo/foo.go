@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+
+	"a"
+)
+
+func main() {
+	fmt.Println("foo", a.A)
+}
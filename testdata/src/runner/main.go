@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		return
+	}
+	switch args[0] {
+	case "exit":
+		fmt.Fprintln(os.Stderr, "exiting")
+		n, _ := strconv.Atoi(args[1])
+		os.Exit(n)
+	case "sleep":
+		time.Sleep(time.Hour)
+	case "dial":
+		if _, err := net.Dial("tcp", args[1]); err != nil {
+			fmt.Println("dial failed")
+			return
+		}
+		fmt.Println("dial succeeded")
+	case "read":
+		if _, err := ioutil.ReadFile(args[1]); err != nil {
+			fmt.Println("read failed")
+			return
+		}
+		fmt.Println("read succeeded")
+	case "write":
+		if err := ioutil.WriteFile(args[1], []byte("x"), 0644); err != nil {
+			fmt.Println("write failed")
+			return
+		}
+		fmt.Println("write succeeded")
+	default:
+		fmt.Println("args:", strings.Join(args, " "))
+	}
+}
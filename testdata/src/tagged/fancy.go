@@ -0,0 +1,7 @@
+//go:build fancy
+
+package main
+
+import "a"
+
+func mode() string { return "fancy " + a.A }
@@ -0,0 +1,5 @@
+//go:build !fancy
+
+package main
+
+func mode() string { return "plain" }
@@ -0,0 +1,23 @@
+package tested
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSandbox(t *testing.T) {
+	if v := os.Getenv("GRB_TEST_SECRET"); v != "" {
+		t.Errorf("the test sees GRB_TEST_SECRET=%s", v)
+	}
+	// Tests may write to their own files.
+	if err := ioutil.WriteFile("tested.go", []byte("overwritten"), 0644); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestSleep is only run (with -run Sleep) to check the time limit.
+func TestSleep(t *testing.T) {
+	time.Sleep(time.Hour)
+}
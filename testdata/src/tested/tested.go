@@ -0,0 +1,8 @@
+package tested
+
+import "a"
+
+// Greeting returns a greeting from package a.
+func Greeting() string {
+	return "hello " + a.A
+}
@@ -0,0 +1,21 @@
+package tested
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestGreeting(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/sub/want.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := Greeting(), strings.TrimSpace(string(b)); got != want {
+		t.Fatalf("got %q; want %q", got, want)
+	}
+}
+
+func TestFailure(t *testing.T) {
+	t.Fatal("failed on purpose")
+}
@@ -0,0 +1,14 @@
+package tested_test
+
+import (
+	"testing"
+
+	"multi/lib"
+	"tested"
+)
+
+func TestLib(t *testing.T) {
+	if tested.Greeting() == lib.Name {
+		t.Fatal("unexpected greeting")
+	}
+}
@@ -0,0 +1,7 @@
+package vetme
+
+import "fmt"
+
+func Print() {
+	fmt.Printf("%d\n", "not a number")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A versionFinder determines the versions of packages from the git
+// checkouts that contain them. It reads the repository metadata directly
+// rather than running git, and it caches results for each repository.
+type versionFinder struct {
+	srcDirs  map[string]bool   // the GOPATH src dirs, where the search stops
+	versions map[string]string // git dir -> version
+}
+
+func newVersionFinder(srcDirs []string) *versionFinder {
+	vf := &versionFinder{
+		srcDirs:  make(map[string]bool),
+		versions: make(map[string]string),
+	}
+	for _, dir := range srcDirs {
+		vf.srcDirs[dir] = true
+	}
+	return vf
+}
+
+// version returns the version of the package in dir: the tag pointing at the
+// checked-out commit, if any, or else the commit hash. It returns "" if the
+// version can't be determined (including for vendored packages, which
+// don't share the version of the repository that vendors them).
+func (vf *versionFinder) version(dir string) string {
+	for d := dir; !vf.srcDirs[d]; {
+		if filepath.Base(d) == "vendor" {
+			return ""
+		}
+		gitDir := filepath.Join(d, ".git")
+		if fi, err := os.Stat(gitDir); err == nil {
+			if !fi.IsDir() {
+				// A worktree or submodule, where .git is a file
+				// saying "gitdir: <path>".
+				b, err := ioutil.ReadFile(gitDir)
+				if err != nil {
+					return ""
+				}
+				s := strings.TrimSpace(strings.TrimPrefix(string(b), "gitdir:"))
+				if !filepath.IsAbs(s) {
+					s = filepath.Join(d, s)
+				}
+				gitDir = s
+			}
+			v, ok := vf.versions[gitDir]
+			if !ok {
+				v = gitVersion(gitDir)
+				vf.versions[gitDir] = v
+			}
+			return v
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return ""
+		}
+		d = parent
+	}
+	return ""
+}
+
+// gitVersion returns the version of the checkout with the given git dir.
+func gitVersion(gitDir string) string {
+	b, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	refs := readGitRefs(gitCommonDir(gitDir))
+	commit := strings.TrimSpace(string(b))
+	if strings.HasPrefix(commit, "ref: ") {
+		commit = refs[strings.TrimPrefix(commit, "ref: ")]
+	}
+	if commit == "" {
+		return ""
+	}
+	var tags []string
+	for ref, c := range refs {
+		if strings.HasPrefix(ref, "refs/tags/") && c == commit {
+			tags = append(tags, strings.TrimPrefix(ref, "refs/tags/"))
+		}
+	}
+	if len(tags) == 0 {
+		return commit
+	}
+	// Prefer the greatest tag, which for the usual vX.Y.Z tags is
+	// most likely to be the release.
+	sort.Strings(tags)
+	return tags[len(tags)-1]
+}
+
+// gitCommonDir returns the directory holding the refs shared by the checkout
+// with the given git dir. For a linked worktree, whose git dir only has its
+// own HEAD, that's the main repository's git dir, named by the commondir file.
+func gitCommonDir(gitDir string) string {
+	b, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+	dir := strings.TrimSpace(string(b))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(gitDir, dir)
+	}
+	return dir
+}
+
+// readGitRefs reads the loose and packed refs of a repository, mapping each
+// ref name to the commit it points to. (Annotated tags are only resolved to
+// commits when they're packed.)
+func readGitRefs(gitDir string) map[string]string {
+	refs := make(map[string]string)
+	if f, err := os.Open(filepath.Join(gitDir, "packed-refs")); err == nil {
+		var last string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "^") && last != "" {
+				refs[last] = line[1:]
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			refs[fields[1]] = fields[0]
+			last = fields[1]
+		}
+		f.Close()
+	}
+	root := filepath.Join(gitDir, "refs")
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(gitDir, path)
+		if err != nil {
+			return nil
+		}
+		refs[filepath.ToSlash(rel)] = strings.TrimSpace(string(b))
+		return nil
+	})
+	return refs
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVersionFinder(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "grb-vcs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+
+	const (
+		commit1 = "1111111111111111111111111111111111111111"
+		commit2 = "2222222222222222222222222222222222222222"
+		tagObj  = "3333333333333333333333333333333333333333"
+	)
+	for name, contents := range map[string]string{
+		// A repo whose checkout has an annotated, packed tag.
+		"tagged/.git/HEAD":              "ref: refs/heads/master\n",
+		"tagged/.git/refs/heads/master": commit1 + "\n",
+		"tagged/.git/packed-refs": "# pack-refs with: peeled fully-peeled sorted\n" +
+			tagObj + " refs/tags/v1.0.0\n^" + commit1 + "\n" +
+			commit2 + " refs/tags/v0.9.0\n",
+		"tagged/sub/x.go": "package sub\n",
+		// A linked worktree of that repo, whose branch is in the main
+		// repo's refs.
+		"worktree/.git":                            "gitdir: ../tagged/.git/worktrees/worktree\n",
+		"tagged/.git/worktrees/worktree/HEAD":      "ref: refs/heads/feature\n",
+		"tagged/.git/worktrees/worktree/commondir": "../..\n",
+		"tagged/.git/refs/heads/feature":           commit2 + "\n",
+		// A repo with a detached, untagged HEAD.
+		"untagged/.git/HEAD":       commit2 + "\n",
+		"untagged/vendor/dep/x.go": "package dep\n",
+		"nogit/x.go":               "package nogit\n",
+	} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A repository above the GOPATH shouldn't be used.
+	if err := os.MkdirAll(filepath.Join(tmp, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, ".git", "HEAD"), []byte(commit1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vf := newVersionFinder([]string{src})
+	for _, tt := range []struct {
+		dir  string
+		want string
+	}{
+		{"tagged", "v1.0.0"},
+		{"tagged/sub", "v1.0.0"},
+		{"worktree", "v0.9.0"},
+		{"untagged", commit2},
+		{"untagged/vendor/dep", ""},
+		{"nogit", ""},
+	} {
+		if got := vf.version(filepath.Join(src, tt.dir)); got != tt.want {
+			t.Errorf("version(%s): got %q; want %q", tt.dir, got, tt.want)
+		}
+	}
+}
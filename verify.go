@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/cespare/grb/internal/grb"
+)
+
+var errNotReproducible = errors.New("build is not reproducible")
+
+// verifyBuild asks the server to build the build with the given ID twice
+// and reports whether the results (and, optionally, a local build of pkgs,
+// the packages sent to the server) are identical.
+func verifyBuild(conf *BuildConfig, client *http.Client, env *Env, id string, pkgs []*grb.Package) error {
+	url := conf.ServerURL + "/verify/" + id
+	log.Println("GET", url)
+	resp, err := client.Get(url)
+	if err != nil {
+		log.Println("Error making GET request:", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 412 {
+		log.Println("Build error:")
+		io.Copy(os.Stderr, resp.Body)
+	}
+	if resp.StatusCode != 200 {
+		log.Println("Non-200 status code from /verify:", resp.StatusCode)
+		return errStatusNot200
+	}
+	var result grb.VerifyResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Println("Could not decode /verify JSON:", err)
+		return err
+	}
+
+	type build struct {
+		name    string
+		summary *grb.BinarySummary
+	}
+	builds := []build{
+		{"server build", result.Builds[0]},
+		{"server build from scratch", result.Builds[1]},
+	}
+	if conf.VerifyLocal {
+		tmp, err := ioutil.TempDir("", "grb-verify-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		// Build from copies of the files that were sent to the server,
+		// rather than from the local GOPATH, which may hold others.
+		gopath := filepath.Join(tmp, "gopath")
+		if err := copyPackages(pkgs, gopath); err != nil {
+			return err
+		}
+		bin := filepath.Join(tmp, "local")
+		log.Println("Building", conf.PkgName, "locally")
+		flags := conf.Flags
+		if pgo := conf.Find.PGO; pgo != "" && pgo != "auto" && pgo != "off" {
+			flags = append(flags[:len(flags):len(flags)], "-pgo", pgo)
+		}
+		if err := localBuild(conf.PkgName, env, gopath, flags, conf.Find.Env, bin); err != nil {
+			return err
+		}
+		summary, err := grb.SummarizeBinary(bin)
+		if err != nil {
+			return err
+		}
+		builds = append(builds, build{"local build", summary})
+	}
+
+	for _, b := range builds {
+		fmt.Fprintf(conf.stdout(), "%s: sha256 %s (%d bytes)\n", b.name, b.summary.SHA256, b.summary.Size)
+	}
+	reproducible := true
+	for _, b := range builds[1:] {
+		diffs := grb.DiffBinaries(builds[0].summary, b.summary)
+		if diffs == nil {
+			continue
+		}
+		reproducible = false
+		fmt.Fprintf(conf.stdout(), "%s differs from %s:\n", b.name, builds[0].name)
+		for _, diff := range diffs {
+			fmt.Fprintf(conf.stdout(), "  %s\n", diff)
+		}
+	}
+	if !reproducible {
+		return errNotReproducible
+	}
+	fmt.Fprintln(conf.stdout(), "Builds are identical")
+	return nil
+}
+
+// copyPackages copies the files of pkgs into a new GOPATH at gopath.
+func copyPackages(pkgs []*grb.Package, gopath string) error {
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			dest := filepath.Join(gopath, "src", filepath.FromSlash(pkg.Name), filepath.FromSlash(file.Name))
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			b, err := ioutil.ReadFile(file.LocalPath)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(dest, b, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// localBuild builds pkgName with the local go command for the platform
+// described by env, and with the environment variables in vars, writing the
+// binary to out.
+func localBuild(pkgName string, env *Env, gopath string, flags []string, vars map[string]string, out string) error {
+	args := append([]string{"build", "-o", out}, flags...)
+	args = append(args, pkgName)
+	cmd := exec.Command("go", args...)
+	cmd.Env = append(os.Environ(),
+		"GOOS="+env.GOOS,
+		"GOARCH="+env.GOARCH,
+		"GO111MODULE=off",
+	)
+	if gopath != "" {
+		cmd.Env = append(cmd.Env, "GOPATH="+gopath)
+	}
+	for name, value := range vars {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("local go build failed: %s\n%s", err, output)
+	}
+	return nil
+}
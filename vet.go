@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cespare/grb/internal/grb"
+)
+
+// errVetFailed is returned when go vet finds problems.
+var errVetFailed = errors.New("go vet found problems")
+
+func vetMain(args []string) {
+	var c grbConfig
+	fs := flag.NewFlagSet("vet", flag.ExitOnError)
+	addBuildFlags(fs, &c)
+	fs.BoolVar(&c.vetJSON, "json", false, "print the diagnostics as JSON")
+	analyzers := fs.String("analyzers", "", "comma-separated list of extra analyzers, configured on the server, to run")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage: grb vet [flags] [packages]
+
+Vet runs go vet, and optionally extra analyzers installed on the build
+server, on the packages (including their tests) for the server's platform.
+The diagnostics refer to the local files. grb vet exits with status 1 if
+there are any.
+
+The flags are:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	c.vet = true
+	c.pkgs = fs.Args()
+	if len(c.pkgs) == 0 {
+		c.pkgs = []string{"."}
+	}
+	if *analyzers != "" {
+		c.analyzers = strings.Split(*analyzers, ",")
+	}
+	c.serverURL = serverURL()
+
+	if err := runGRB(c); err != nil {
+		if err == errVetFailed {
+			os.Exit(1)
+		}
+		log.Fatalln("Fatal error:", err)
+	}
+}
+
+// runVet vets the packages of the build with the given ID on the server and
+// prints the diagnostics, which refer to the files in pkgs.
+func runVet(conf *BuildConfig, client *http.Client, id string, pkgs []*grb.Package) error {
+	url := conf.ServerURL + "/vet/" + id
+	log.Println("GET", url)
+	resp, err := client.Get(url)
+	if err != nil {
+		log.Println("Error making GET request:", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 412 {
+		log.Println("Build error:")
+		io.Copy(os.Stderr, resp.Body)
+	}
+	if resp.StatusCode != 200 {
+		log.Println("Non-200 status code from /vet:", resp.StatusCode)
+		return errStatusNot200
+	}
+	var result grb.VetResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Println("Could not decode /vet JSON:", err)
+		return err
+	}
+	localPaths := make(map[[2]string]string)
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			localPaths[[2]string{pkg.Name, file.Name}] = file.LocalPath
+		}
+	}
+	for i := range result.Diagnostics {
+		d := &result.Diagnostics[i]
+		d.LocalPath = localPaths[[2]string{d.Package, d.File}]
+	}
+
+	out := conf.stdout()
+	if conf.VetJSON {
+		b, err := json.MarshalIndent(&result, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\n", b)
+	} else {
+		for _, d := range result.Diagnostics {
+			fmt.Fprintln(out, d.String())
+		}
+		io.WriteString(out, result.Output)
+	}
+	if len(result.Diagnostics) > 0 || result.Output != "" {
+		return errVetFailed
+	}
+	return nil
+}